@@ -0,0 +1,359 @@
+package gator
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/**
+Network Working Group                                           M. Leech
+Request for Comments: 1929                    Bell-Northern Research Ltd
+Category: Standards Track                                     March 1996
+
+		Username/Password Authentication for SOCKS V5
+
+2.  Initial negotiation
+
+   Once the SOCKS V5 server has started, and the client has selected the
+   Username/Password Authentication protocol, the Username/Password
+   subnegotiation begins.  This begins with the client producing a
+   Username/Password request:
+
+           +----+------+----------+------+----------+
+           |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+           +----+------+----------+------+----------+
+           | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+           +----+------+----------+------+----------+
+
+   The VER field contains the current version of the subnegotiation,
+   which is X'01'. The ULEN field contains the length of the UNAME field
+   that follows. The UNAME field contains the username as known to the
+   source operating system. The PLEN field contains the length of the
+   PASSWD field that follows. The PASSWD field contains the password
+   association with the given UNAME.
+
+   The server verifies the supplied UNAME and PASSWD, and sends the
+   following response:
+
+                        +----+--------+
+                        |VER | STATUS |
+                        +----+--------+
+                        | 1  |   1    |
+                        +----+--------+
+
+   A STATUS field of X'00' indicates success. If the server returns a
+   `failure' (STATUS value other than X'00') status, it MUST close the
+   connection.
+*/
+
+type Auth5Request struct {
+	Version  byte
+	Username string
+	Password string
+}
+
+type Auth5Reply struct {
+	Version byte
+	Status  byte
+}
+
+// Identity is who a client authenticated as. It is attached to the session
+// for logging and for later stages such as access control.
+type Identity struct {
+	// Name is the authenticated username, empty for anonymous clients.
+	Name string
+
+	// Method is the SOCKS5 METHOD the client authenticated with.
+	Method byte
+}
+
+// Authenticator verifies clients before their requests are served. A server
+// consults its authenticators in its order of preference.
+type Authenticator interface {
+	// Method is the SOCKS5 METHOD code this authenticator negotiates.
+	Method() byte
+
+	// Negotiate runs the method-specific SOCKS5 sub-negotiation on rw.
+	Negotiate(rw io.ReadWriter) (*Identity, error)
+
+	// UserID checks the USERID of a SOCKS4 request.
+	UserID(userid string) (*Identity, error)
+
+	// Password checks the credentials of an HTTP Proxy-Authorization
+	// header.
+	Password(username, password string) (*Identity, error)
+}
+
+// errUserIDUnsupported is returned by authenticators that have no way to
+// verify a SOCKS4 client.
+var errUserIDUnsupported = errors.New("SOCKS4 clients cannot use this authentication method")
+
+// NoAuth accepts every client without authentication.
+type NoAuth struct{}
+
+// UserPassAuth is the username/password method of RFC 1929.
+type UserPassAuth struct {
+	Credentials CredentialStore
+}
+
+// CredentialStore checks the username and password a client presents.
+type CredentialStore interface {
+	Check(username, password string) bool
+}
+
+// StaticCredentials holds plain text passwords by username, as read from a
+// file of "username:password" lines.
+type StaticCredentials map[string]string
+
+// HtpasswdCredentials holds bcrypt password hashes by username, as read from
+// an htpasswd file created with "htpasswd -B".
+type HtpasswdCredentials map[string][]byte
+
+func (id *Identity) String() string {
+	if id == nil || id.Name == "" {
+		return "anonymous"
+	}
+	return id.Name
+}
+
+// selectMethod returns the first of authenticators whose method the client
+// offers, or nil if there is none.
+func selectMethod(authenticators []Authenticator, methods []byte) Authenticator {
+	for _, a := range authenticators {
+		for _, m := range methods {
+			if a.Method() == m {
+				return a
+			}
+		}
+	}
+	return nil
+}
+
+// authenticateUserID returns the identity of the first of authenticators
+// that accepts userid.
+func authenticateUserID(authenticators []Authenticator, userid string) (*Identity, error) {
+	err := errUserIDUnsupported
+	for _, a := range authenticators {
+		var id *Identity
+		if id, err = a.UserID(userid); err == nil {
+			return id, nil
+		}
+	}
+	return nil, err
+}
+
+func (NoAuth) Method() byte {
+	return 0x00
+}
+
+func (NoAuth) Negotiate(rw io.ReadWriter) (*Identity, error) {
+	return &Identity{Method: 0x00}, nil
+}
+
+// UserID accepts any USERID. It is not verified, so it does not become the
+// name of the identity.
+func (NoAuth) UserID(userid string) (*Identity, error) {
+	return &Identity{Method: 0x00}, nil
+}
+
+// Password accepts any credentials, they are not verified.
+func (NoAuth) Password(username, password string) (*Identity, error) {
+	return &Identity{Method: 0x00}, nil
+}
+
+func (a *UserPassAuth) Method() byte {
+	return 0x02
+}
+
+func (a *UserPassAuth) Negotiate(rw io.ReadWriter) (*Identity, error) {
+	ar := new(Auth5Request)
+	if err := ar.ReadBinary(rw); err != nil {
+		return nil, err
+	}
+
+	rep := Auth5Reply{Version: 0x01, Status: 0x00}
+	identity, err := a.Password(ar.Username, ar.Password)
+	if err != nil {
+		rep.Status = 0x01
+		rep.WriteBinary(rw)
+		return nil, err
+	}
+
+	if err := rep.WriteBinary(rw); err != nil {
+		return nil, fmt.Errorf("respond: %s", err)
+	}
+
+	return identity, nil
+}
+
+// UserID always fails, SOCKS4 has no password to check.
+func (a *UserPassAuth) UserID(userid string) (*Identity, error) {
+	return nil, errUserIDUnsupported
+}
+
+func (a *UserPassAuth) Password(username, password string) (*Identity, error) {
+	if !a.Credentials.Check(username, password) {
+		return nil, fmt.Errorf("%w for user %q", errAuthFailed, username)
+	}
+	return &Identity{Name: username, Method: 0x02}, nil
+}
+
+// Check compares the password of an unknown user as well, so that the time
+// it takes does not tell which users exist.
+func (c StaticCredentials) Check(username, password string) bool {
+	expected, ok := c[username]
+	if !ok {
+		expected = password
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 && ok
+}
+
+// Check compares the password of an unknown user against the hash of
+// another one, so that the time it takes does not tell which users exist.
+func (c HtpasswdCredentials) Check(username, password string) bool {
+	hash, ok := c[username]
+	if !ok {
+		for _, dummy := range c {
+			bcrypt.CompareHashAndPassword(dummy, []byte(password))
+			break
+		}
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// LoadStaticCredentials reads a file of "username:password" lines. Blank
+// lines and lines starting with # are ignored.
+func LoadStaticCredentials(path string) (StaticCredentials, error) {
+	c := make(StaticCredentials)
+	err := readPasswordFile(path, func(username, password string) error {
+		c[username] = password
+		return nil
+	})
+	return c, err
+}
+
+// LoadHtpasswd reads an htpasswd file. Only bcrypt hashes are supported.
+func LoadHtpasswd(path string) (HtpasswdCredentials, error) {
+	c := make(HtpasswdCredentials)
+	err := readPasswordFile(path, func(username, hash string) error {
+		if !strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf("user %s: only bcrypt hashes are supported", username)
+		}
+		c[username] = []byte(hash)
+		return nil
+	})
+	return c, err
+}
+
+func readPasswordFile(path string, add func(username, password string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return fmt.Errorf("%s:%d: expected username:password", path, n)
+		}
+		if err := add(line[:i], line[i+1:]); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *Auth5Request) ReadBinary(r io.Reader) error {
+	b := make([]byte, 2)
+
+	if err := readFull(r, b, "Auth5Request"); err != nil {
+		return err
+	}
+
+	if s.Version = b[0]; s.Version != 0x01 {
+		return &ProtocolError{Message: "Auth5Request", Err: fmt.Errorf("%w %d", ErrVersion, s.Version)}
+	}
+
+	// RFC 1929: ULEN and PLEN are 1 to 255.
+	if b[1] == 0 {
+		return &ProtocolError{Message: "Auth5Request", Err: fmt.Errorf("%w: empty username", ErrMalformed)}
+	}
+	username := make([]byte, int(b[1]))
+	if err := readFull(r, username, "Auth5Request"); err != nil {
+		return err
+	}
+	s.Username = string(username)
+
+	if err := readFull(r, b[:1], "Auth5Request"); err != nil {
+		return err
+	}
+
+	if b[0] == 0 {
+		return &ProtocolError{Message: "Auth5Request", Err: fmt.Errorf("%w: empty password", ErrMalformed)}
+	}
+	password := make([]byte, int(b[0]))
+	if err := readFull(r, password, "Auth5Request"); err != nil {
+		return err
+	}
+	s.Password = string(password)
+
+	return nil
+}
+
+func (s *Auth5Request) WriteBinary(w io.Writer) error {
+	if len(s.Username) > 255 || len(s.Password) > 255 {
+		return errors.New("Cannot write Auth5Request, username or password too long")
+	}
+	if len(s.Username) == 0 || len(s.Password) == 0 {
+		return errors.New("Cannot write Auth5Request, username or password empty")
+	}
+
+	b := make([]byte, 0, 3+len(s.Username)+len(s.Password))
+	b = append(b, s.Version, byte(len(s.Username)))
+	b = append(b, s.Username...)
+	b = append(b, byte(len(s.Password)))
+	b = append(b, s.Password...)
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("Error writing Auth5Request: %v", err)
+	}
+
+	return nil
+}
+
+func (s *Auth5Reply) ReadBinary(r io.Reader) error {
+	b := make([]byte, 2)
+	if err := readFull(r, b, "Auth5Reply"); err != nil {
+		return err
+	}
+
+	if s.Version = b[0]; s.Version != 0x01 {
+		return &ProtocolError{Message: "Auth5Reply", Err: fmt.Errorf("%w %d", ErrVersion, s.Version)}
+	}
+	s.Status = b[1]
+
+	return nil
+}
+
+func (s *Auth5Reply) WriteBinary(w io.Writer) error {
+	out := []byte{s.Version, s.Status}
+	if _, err := w.Write(out); err != nil {
+		return fmt.Errorf("Error writing Auth5Reply: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package gator
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadStaticCredentials(t *testing.T) {
+	c, err := LoadStaticCredentials("testdata/auth/passwords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCredentials(t, c, []credentialsTest{
+		{"alice", "secret", true},
+		{"alice", "Secret", false},
+		{"alice", "", false},
+		{"bob", "pa:ss", true},
+		{"bob", "pa", false},
+		{"carol", "secret", false},
+		{"", "", false},
+	})
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	c, err := LoadHtpasswd("testdata/auth/htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCredentials(t, c, []credentialsTest{
+		{"alice", "secret", true},
+		{"alice", "secret ", false},
+		{"carol", "secret", false},
+	})
+}
+
+type credentialsTest struct {
+	username, password string
+	want               bool
+}
+
+// checkCredentials checks the answer of c to every test.
+func checkCredentials(t *testing.T, c CredentialStore, tests []credentialsTest) {
+	t.Helper()
+	for _, tt := range tests {
+		if got := c.Check(tt.username, tt.password); got != tt.want {
+			t.Errorf("Check(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+	}
+}
+
+// TestHtpasswdUnknownUser checks that an unknown user is not turned away
+// faster than a wrong password.
+func TestHtpasswdUnknownUser(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := HtpasswdCredentials{"alice": hash}
+
+	timeCheck := func(username string) time.Duration {
+		start := time.Now()
+		c.Check(username, "wrong")
+		return time.Since(start)
+	}
+	known, unknown := timeCheck("alice"), timeCheck("carol")
+	if unknown < known/4 {
+		t.Errorf("unknown user checked in %s, a known one in %s", unknown, known)
+	}
+}
@@ -0,0 +1,57 @@
+package gator
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// listenBind opens the socket a BIND request waits on. It listens on the
+// address the client reached us on, so that the address reported back is
+// one the application server can connect to.
+func listenBind(client net.Conn) (*net.TCPListener, error) {
+	host, _, _ := net.SplitHostPort(client.LocalAddr().String())
+	return net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(host)})
+}
+
+// acceptBind waits up to timeout for the application server to connect,
+// and gives up with errHungUp as soon as the client hangs up. The listener
+// is only ever used for a single connection.
+func acceptBind(client net.Conn, ln *net.TCPListener, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		ln.SetDeadline(time.Now().Add(timeout))
+	}
+
+	hungUp := watchHangup(client, func() { ln.Close() })
+	conn, err := ln.Accept()
+	if hungUp() {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, errHungUp
+	}
+	return conn, err
+}
+
+// bindPeerAllowed reports whether peer is the host the client named in its
+// BIND request, given either as an IP or as a domain name resolved with r.
+// An unspecified address accepts any peer.
+func bindPeerAllowed(peer net.Addr, ip net.IP, domain string, r Resolver) bool {
+	host, _, _ := net.SplitHostPort(peer.String())
+	peerIP := net.ParseIP(host)
+
+	if domain == "" {
+		return ip.IsUnspecified() || ip.Equal(peerIP)
+	}
+
+	ips, err := lookupIP(context.Background(), r, "ip", domain)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(peerIP) {
+			return true
+		}
+	}
+	return false
+}
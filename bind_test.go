@@ -0,0 +1,177 @@
+package gator
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// dialProxy connects to the proxy at addr, with a deadline for the test.
+func dialProxy(t *testing.T, addr net.Addr) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr.String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// checkClosed checks that the listener at addr has been closed shortly
+// after. Connecting would end the wait of a BIND for good, so it is only
+// tried once.
+func checkClosed(t *testing.T, addr string) {
+	t.Helper()
+	time.Sleep(200 * time.Millisecond)
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Fatalf("%s still listening", addr)
+	}
+}
+
+func TestSocks5Bind(t *testing.T) {
+	proxy := startServer(t, "tcp4")
+	loopback := net.IPv4(127, 0, 0, 1)
+
+	// bind runs a BIND expecting a peer at ip, and connects to the address
+	// of the first reply from the loopback address.
+	bind := func(ip net.IP) (client, peer net.Conn, second *Socks5Reply) {
+		t.Helper()
+		client = dialProxy(t, proxy)
+		rep, err := socks5Command(client, CmdBind, ip, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Reply != 0x00 || !rep.Address.Equal(loopback) || rep.Port == 0 {
+			t.Fatalf("first reply %#02x %s:%d, want success on the loopback address", rep.Reply, rep.Address, rep.Port)
+		}
+		peer, err = net.Dial("tcp4", net.JoinHostPort(rep.Address.String(), strconv.Itoa(int(rep.Port))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { peer.Close() })
+		second = new(Socks5Reply)
+		if err := second.ReadBinary(client); err != nil {
+			t.Fatal(err)
+		}
+		return client, peer, second
+	}
+
+	client, peer, rep := bind(loopback)
+	if rep.Reply != 0x00 || !rep.Address.Equal(loopback) || int(rep.Port) != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("second reply %#02x %s:%d, want success with the peer address %s", rep.Reply, rep.Address, rep.Port, peer.LocalAddr())
+	}
+	go func() {
+		b := make([]byte, 64)
+		n, _ := peer.Read(b)
+		peer.Write(b[:n])
+	}()
+	checkEcho(t, client)
+
+	// Another host than the one named connects.
+	_, _, rep = bind(net.ParseIP("192.0.2.1"))
+	if rep.Reply != 0x02 {
+		t.Errorf("reply to an unexpected peer %#02x, want 0x02", rep.Reply)
+	}
+}
+
+func TestSocks5BindTimeout(t *testing.T) {
+	proxy := startServer(t, "tcp4")
+	s := &Server{Authenticators: []Authenticator{NoAuth{}}, BindTimeout: 50 * time.Millisecond}
+	timed := serve(t, "tcp4", s)
+
+	client := dialProxy(t, timed)
+	if _, err := socks5Command(client, CmdBind, net.IPv4zero, 0); err != nil {
+		t.Fatal(err)
+	}
+	rep := new(Socks5Reply)
+	if err := rep.ReadBinary(client); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Reply != 0x06 {
+		t.Errorf("reply after the bind timeout %#02x, want 0x06", rep.Reply)
+	}
+
+	// Without a timeout, the listener goes away with the client.
+	client = dialProxy(t, proxy)
+	first, err := socks5Command(client, CmdBind, net.IPv4zero, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	checkClosed(t, net.JoinHostPort(first.Address.String(), strconv.Itoa(int(first.Port))))
+}
+
+// socks4Bind runs a SOCKS4 BIND expecting a peer at ip and returns the first
+// reply.
+func socks4Bind(t *testing.T, client net.Conn, ip net.IP) *Socks4Reply {
+	t.Helper()
+	req := &Socks4Request{Command: CmdBind, Address: ip.To4(), Port: 0}
+	if err := req.WriteBinary(client); err != nil {
+		t.Fatal(err)
+	}
+	rep := new(Socks4Reply)
+	if err := rep.ReadBinary(client); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Command != 90 || rep.Port == 0 {
+		t.Fatalf("first reply %d port %d, want 90 with a port", rep.Command, rep.Port)
+	}
+	return rep
+}
+
+func TestSocks4Bind(t *testing.T) {
+	proxy := startServer(t, "tcp4")
+	loopback := net.IPv4(127, 0, 0, 1)
+
+	bind := func(ip net.IP) (client, peer net.Conn, second *Socks4Reply) {
+		t.Helper()
+		client = dialProxy(t, proxy)
+		rep := socks4Bind(t, client, ip)
+		peer, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(rep.Port))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { peer.Close() })
+		second = new(Socks4Reply)
+		if err := second.ReadBinary(client); err != nil {
+			t.Fatal(err)
+		}
+		return client, peer, second
+	}
+
+	client, peer, rep := bind(loopback)
+	if rep.Command != 90 || int(rep.Port) != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("second reply %d port %d, want 90 with the port of %s", rep.Command, rep.Port, peer.LocalAddr())
+	}
+	go func() {
+		b := make([]byte, 64)
+		n, _ := peer.Read(b)
+		peer.Write(b[:n])
+	}()
+	checkEcho(t, client)
+
+	_, _, rep = bind(net.ParseIP("192.0.2.1"))
+	if rep.Command != 91 {
+		t.Errorf("reply to an unexpected peer %d, want 91", rep.Command)
+	}
+}
+
+func TestSocks4BindTimeout(t *testing.T) {
+	proxy := startServer(t, "tcp4")
+	timed := serve(t, "tcp4", &Server{Authenticators: []Authenticator{NoAuth{}}, BindTimeout: 50 * time.Millisecond})
+
+	// SOCKS4 has no reply for the timeout, the connection is closed.
+	client := dialProxy(t, timed)
+	socks4Bind(t, client, net.IPv4zero)
+	if err := new(Socks4Reply).ReadBinary(client); err == nil {
+		t.Error("second reply after the bind timeout")
+	}
+
+	client = dialProxy(t, proxy)
+	first := socks4Bind(t, client, net.IPv4zero)
+	client.Close()
+	checkClosed(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(int(first.Port))))
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/winxxp/gator"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the configuration of gator, read from a YAML file or built
+// from the command line flags.
+type config struct {
+	Listeners []listenerConfig `yaml:"listeners"`
+	Auth      authConfig       `yaml:"auth"`
+
+	// Rules are rules in the format of gator.ParseRule, tried in order.
+	// Requests that no rule matches are denied. No rules allow everything.
+	Rules []string `yaml:"rules"`
+
+	// Upstream is the URL of a proxy to connect to destinations through,
+	// or a comma separated list of them, in the format of
+	// gator.ParseUpstreams. Direct connections if empty.
+	Upstream string `yaml:"upstream"`
+
+	// Balance is how to pick among several upstreams of Upstream,
+	// round-robin, least-connections or hash.
+	Balance string `yaml:"balance"`
+
+	// Health configures the probes of the upstreams of Upstream and of
+	// the routes, when there are several.
+	Health healthConfig `yaml:"health"`
+
+	// Routes are routes in the format of gator.ParseRoute, tried in order
+	// before Upstream.
+	Routes []string `yaml:"routes"`
+
+	DNS      dnsConfig      `yaml:"dns"`
+	Outbound outboundConfig `yaml:"outbound"`
+	Guard    guardConfig    `yaml:"guard"`
+	Timeouts timeoutConfig  `yaml:"timeouts"`
+	Log      logConfig      `yaml:"log"`
+}
+
+type listenerConfig struct {
+	// Network is tcp, the default, tcp4, tcp6 or unix.
+	Network string `yaml:"network"`
+
+	// Address is host:port for TCP, an empty host listens on all
+	// addresses, and the path of the socket for unix.
+	Address string `yaml:"address"`
+
+	// Mode are the permissions of a Unix socket in octal, such as "0660".
+	Mode string `yaml:"mode"`
+
+	// Protocols are the protocols served, socks4, socks5 and http, all of
+	// them if empty.
+	Protocols []string `yaml:"protocols"`
+
+	// Auth replaces the auth section for this listener.
+	Auth *authConfig `yaml:"auth"`
+
+	// Outbound replaces the source and interface of the outbound section
+	// for this listener.
+	Outbound *egressConfig `yaml:"outbound"`
+}
+
+type authConfig struct {
+	// Anonymous allows clients that do not authenticate.
+	Anonymous bool `yaml:"anonymous"`
+
+	// File is a file of username:password lines, Htpasswd an htpasswd file
+	// with bcrypt hashes. At most one of them may be set.
+	File     string `yaml:"file"`
+	Htpasswd string `yaml:"htpasswd"`
+}
+
+type dnsConfig struct {
+	// Resolver is system, the default, or a DNS server in the format of
+	// gator.ParseResolver.
+	Resolver string `yaml:"resolver"`
+
+	// Hosts is a hosts file, its names are resolved without asking
+	// Resolver.
+	Hosts string `yaml:"hosts"`
+
+	// TTL, MaxTTL, NegativeTTL and CacheSize tune the cache of answers,
+	// see gator.Cache.
+	TTL         time.Duration `yaml:"ttl"`
+	MaxTTL      time.Duration `yaml:"max-ttl"`
+	NegativeTTL time.Duration `yaml:"negative-ttl"`
+	CacheSize   int           `yaml:"cache-size"`
+}
+
+type outboundConfig struct {
+	// Family is happy-eyeballs, the default, prefer-v4, prefer-v6, v4-only
+	// or v6-only, see gator.AddressFamily.
+	Family string `yaml:"family"`
+
+	// Stagger is the time between the attempts of happy-eyeballs.
+	Stagger time.Duration `yaml:"stagger"`
+
+	egressConfig `yaml:",inline"`
+
+	// Users replaces the source and interface for the clients
+	// authenticated as its user names, on every listener.
+	Users map[string]egressConfig `yaml:"users"`
+}
+
+type egressConfig struct {
+	// Source is the local IP address connections leave from, Interface
+	// the network interface they are bound to, see gator.Egress.
+	Source    string `yaml:"source"`
+	Interface string `yaml:"interface"`
+}
+
+type guardConfig struct {
+	// Deny are the networks destinations may not resolve to, "default"
+	// stands for gator.DefaultDeny. Allow are exceptions to Deny.
+	Deny  []string `yaml:"deny"`
+	Allow []string `yaml:"allow"`
+}
+
+type healthConfig struct {
+	// Interval is the time between probes, no probes if zero.
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+
+	// Canary is a host:port to connect to through the upstreams, if
+	// empty probes only connect to the upstreams themselves.
+	Canary string `yaml:"canary"`
+}
+
+type timeoutConfig struct {
+	Handshake time.Duration `yaml:"handshake"`
+	Connect   time.Duration `yaml:"connect"`
+	Bind      time.Duration `yaml:"bind"`
+
+	// Drain is how long sessions may take to finish on SIGTERM or SIGINT.
+	Drain time.Duration `yaml:"drain"`
+}
+
+type logConfig struct {
+	// File is appended to, standard error if empty.
+	File string `yaml:"file"`
+}
+
+// defaultConfig is the configuration that a file or the flags amend.
+func defaultConfig() *config {
+	return &config{
+		Guard: guardConfig{Deny: []string{"default"}},
+		Timeouts: timeoutConfig{
+			Handshake: 10 * time.Second,
+			Connect:   30 * time.Second,
+			Bind:      2 * time.Minute,
+			Drain:     30 * time.Second,
+		},
+	}
+}
+
+// loadConfig reads and validates a configuration file. Unknown keys are
+// errors, so that typos do not go unnoticed.
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := defaultConfig()
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return c, nil
+}
+
+// validate checks what can be checked without building the servers.
+func (c *config) validate() error {
+	if len(c.Listeners) == 0 {
+		return errors.New("listeners: none configured")
+	}
+	seen := make(map[string]bool)
+	globalAuth := false
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("listeners[%d]: %s", i, err)
+		}
+		if seen[l.key()] {
+			return fmt.Errorf("listeners[%d]: %s is listed twice", i, l.Address)
+		}
+		seen[l.key()] = true
+		globalAuth = globalAuth || l.Auth == nil
+	}
+
+	// The auth section only matters to listeners without one of their own.
+	if globalAuth {
+		if err := c.Auth.validate(); err != nil {
+			return fmt.Errorf("auth: %s", err)
+		}
+	}
+
+	for name, d := range map[string]time.Duration{
+		"timeouts.handshake": c.Timeouts.Handshake,
+		"timeouts.connect":   c.Timeouts.Connect,
+		"timeouts.bind":      c.Timeouts.Bind,
+		"timeouts.drain":     c.Timeouts.Drain,
+		"health.interval":    c.Health.Interval,
+		"health.timeout":     c.Health.Timeout,
+		"dns.ttl":            c.DNS.TTL,
+		"dns.max-ttl":        c.DNS.MaxTTL,
+		"dns.negative-ttl":   c.DNS.NegativeTTL,
+		"outbound.stagger":   c.Outbound.Stagger,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s: %s is negative", name, d)
+		}
+	}
+
+	if c.Balance != "" {
+		if _, err := gator.ParseBalance(c.Balance); err != nil {
+			return fmt.Errorf("balance: %s", err)
+		}
+	}
+	if c.Health.Canary != "" {
+		if _, _, err := net.SplitHostPort(c.Health.Canary); err != nil {
+			return fmt.Errorf("health.canary: %s", err)
+		}
+	}
+
+	if c.DNS.Resolver != "" {
+		if _, err := gator.ParseResolver(c.DNS.Resolver); err != nil {
+			return fmt.Errorf("dns.resolver: %s", err)
+		}
+	}
+	if c.DNS.CacheSize < 0 {
+		return fmt.Errorf("dns.cache-size: %d is negative", c.DNS.CacheSize)
+	}
+	if c.Outbound.Family != "" {
+		if _, err := gator.ParseAddressFamily(c.Outbound.Family); err != nil {
+			return fmt.Errorf("outbound.family: %s", err)
+		}
+	}
+	if _, err := c.Outbound.egress(); err != nil {
+		return fmt.Errorf("outbound.%s", err)
+	}
+	for name, e := range c.Outbound.Users {
+		if _, err := e.egress(); err != nil {
+			return fmt.Errorf("outbound.users.%s.%s", name, err)
+		}
+	}
+	return nil
+}
+
+func (l *listenerConfig) validate() error {
+	switch l.network() {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return err
+		}
+		if l.Mode != "" {
+			return errors.New("mode only applies to unix sockets")
+		}
+	case "unix":
+		if l.Address == "" {
+			return errors.New("address: no socket path")
+		}
+		if _, err := l.mode(); err != nil {
+			return fmt.Errorf("mode: %s", err)
+		}
+	default:
+		return fmt.Errorf("network: unknown network %q", l.Network)
+	}
+
+	if _, err := gator.ParseProtocols(strings.Join(l.Protocols, ",")); err != nil {
+		return fmt.Errorf("protocols: %s", err)
+	}
+
+	if l.Auth != nil {
+		if err := l.Auth.validate(); err != nil {
+			return fmt.Errorf("auth: %s", err)
+		}
+	}
+	if l.Outbound != nil {
+		if _, err := l.Outbound.egress(); err != nil {
+			return fmt.Errorf("outbound.%s", err)
+		}
+	}
+	return nil
+}
+
+// egress parses e. Errors start with the key at fault.
+func (e *egressConfig) egress() (gator.Egress, error) {
+	egress := gator.Egress{Interface: e.Interface}
+	if e.Source != "" {
+		if egress.LocalAddr = net.ParseIP(e.Source); egress.LocalAddr == nil {
+			return egress, fmt.Errorf("source: invalid address %q", e.Source)
+		}
+	}
+	return egress, nil
+}
+
+func (a *authConfig) validate() error {
+	if a.File != "" && a.Htpasswd != "" {
+		return errors.New("file and htpasswd cannot both be set")
+	}
+	if !a.Anonymous && a.File == "" && a.Htpasswd == "" {
+		return errors.New("no credentials configured, set anonymous to allow clients that do not authenticate")
+	}
+	return nil
+}
+
+// servers builds a server for every listener, loading the files the
+// configuration refers to.
+func (c *config) servers() ([]*gator.Server, error) {
+	guard, err := c.Guard.guard()
+	if err != nil {
+		return nil, err
+	}
+
+	var rules gator.RuleSet
+	if len(c.Rules) > 0 {
+		list := &gator.RuleList{Default: gator.Deny}
+		for i, line := range c.Rules {
+			rule, err := gator.ParseRule(line)
+			if err != nil {
+				return nil, fmt.Errorf("rules[%d]: %s", i, err)
+			}
+			list.Rules = append(list.Rules, rule)
+		}
+		rules = list
+	}
+
+	var routes []gator.Route
+	for i, line := range c.Routes {
+		route, err := gator.ParseRoute(line)
+		if err != nil {
+			return nil, fmt.Errorf("routes[%d]: %s", i, err)
+		}
+		routes = append(routes, route)
+	}
+	resolver, err := c.DNS.resolver()
+	if err != nil {
+		return nil, err
+	}
+
+	// Validated already.
+	family, _ := gator.ParseAddressFamily(c.Outbound.Family)
+	egress, _ := c.Outbound.egress()
+	var users map[string]gator.Egress
+	if len(c.Outbound.Users) > 0 {
+		users = make(map[string]gator.Egress)
+		for name, e := range c.Outbound.Users {
+			users[name], _ = e.egress()
+		}
+	}
+
+	var servers []*gator.Server
+	for i, l := range c.Listeners {
+		srv := &gator.Server{
+			Guard:            guard,
+			Resolver:         resolver,
+			Family:           family,
+			Stagger:          c.Outbound.Stagger,
+			Egress:           egress,
+			UserEgress:       users,
+			Rules:            rules,
+			BindTimeout:      c.Timeouts.Bind,
+			ConnectTimeout:   c.Timeouts.Connect,
+			HandshakeTimeout: c.Timeouts.Handshake,
+		}
+		// Validated already.
+		srv.Protocols, _ = gator.ParseProtocols(strings.Join(l.Protocols, ","))
+		if l.Outbound != nil {
+			srv.Egress, _ = l.Outbound.egress()
+		}
+
+		auth, section := &c.Auth, "auth"
+		if l.Auth != nil {
+			auth, section = l.Auth, fmt.Sprintf("listeners[%d].auth", i)
+		}
+		if srv.Authenticators, err = auth.authenticators(); err != nil {
+			return nil, fmt.Errorf("%s: %s", section, err)
+		}
+		servers = append(servers, srv)
+	}
+
+	d, err := c.dialer(routes, direct(servers[0]))
+	if err != nil {
+		return nil, err
+	}
+	for _, srv := range servers {
+		srv.Dialer = d
+	}
+	return servers, nil
+}
+
+// direct returns a dialer that connects to destinations as srv does
+// without a Dialer.
+func direct(srv *gator.Server) *gator.DirectDialer {
+	return &gator.DirectDialer{
+		Resolver: srv.Resolver,
+		Family:   srv.Family,
+		Stagger:  srv.Stagger,
+		Control:  srv.Guard.Control,
+	}
+}
+
+// dialer returns the dialer of routes and Upstream, nil to connect to
+// every destination directly. Direct routes connect with direct.
+func (c *config) dialer(routes []gator.Route, direct *gator.DirectDialer) (gator.Dialer, error) {
+	var d gator.Dialer
+	if c.Upstream != "" {
+		// Validated already.
+		balance, _ := gator.ParseBalance(c.Balance)
+		var err error
+		if d, err = gator.ParseUpstreams(c.Upstream, balance); err != nil {
+			return nil, fmt.Errorf("upstream: %s", err)
+		}
+		if len(routes) > 0 {
+			routes = append(routes, gator.Route{Via: c.Upstream, Dialer: d})
+		}
+	}
+	if len(routes) > 0 {
+		d = &gator.Router{Routes: routes, Direct: direct}
+	}
+
+	for _, pool := range pools(d) {
+		pool.Interval = c.Health.Interval
+		pool.Timeout = c.Health.Timeout
+		pool.Canary = c.Health.Canary
+		// Validated already.
+		pool.Egress, _ = c.Outbound.egress()
+	}
+	// SOCKS4 upstreams that cannot resolve names get them resolved as the
+	// direct connections do.
+	for _, u := range upstreams(d) {
+		if socks4, ok := u.(*gator.SOCKS4Dialer); ok {
+			socks4.Resolver = direct.Resolver
+		}
+	}
+	return d, nil
+}
+
+// resolver returns the resolver of the section, behind a cache, loading the
+// hosts file if there is one.
+func (d *dnsConfig) resolver() (gator.Resolver, error) {
+	var r gator.Resolver = net.DefaultResolver
+	if d.Resolver != "" {
+		var err error
+		if r, err = gator.ParseResolver(d.Resolver); err != nil {
+			return nil, fmt.Errorf("dns.resolver: %s", err)
+		}
+	}
+	if d.Hosts != "" {
+		hosts, err := gator.LoadHosts(d.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("dns.hosts: %s", err)
+		}
+		hosts.Fallback = r
+		r = hosts
+	}
+	return &gator.Cache{
+		Resolver:    r,
+		TTL:         d.TTL,
+		MaxTTL:      d.MaxTTL,
+		NegativeTTL: d.NegativeTTL,
+		Size:        d.CacheSize,
+	}, nil
+}
+
+// pools returns the pools of d, which is a Pool or a Router.
+func pools(d gator.Dialer) []*gator.Pool {
+	switch d := d.(type) {
+	case *gator.Pool:
+		return []*gator.Pool{d}
+	case *gator.Router:
+		var list []*gator.Pool
+		for _, route := range d.Routes {
+			list = append(list, pools(route.Dialer)...)
+		}
+		return list
+	}
+	return nil
+}
+
+// upstreams returns the dialers of the single upstreams of d, which is a
+// Router, a Pool or one of them.
+func upstreams(d gator.Dialer) []gator.Dialer {
+	switch d := d.(type) {
+	case nil:
+		return nil
+	case *gator.Pool:
+		return d.Upstreams
+	case *gator.Router:
+		var list []gator.Dialer
+		for _, route := range d.Routes {
+			list = append(list, upstreams(route.Dialer)...)
+		}
+		return list
+	}
+	return []gator.Dialer{d}
+}
+
+// authenticators loads the credentials of the section.
+func (a *authConfig) authenticators() ([]gator.Authenticator, error) {
+	var credentials gator.CredentialStore
+	var err error
+	switch {
+	case a.File != "":
+		credentials, err = gator.LoadStaticCredentials(a.File)
+	case a.Htpasswd != "":
+		credentials, err = gator.LoadHtpasswd(a.Htpasswd)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Prefer username/password, so that clients are identified even when
+	// anonymous access is allowed.
+	var authenticators []gator.Authenticator
+	if credentials != nil {
+		authenticators = append(authenticators, &gator.UserPassAuth{Credentials: credentials})
+	}
+	if a.Anonymous {
+		authenticators = append(authenticators, gator.NoAuth{})
+	}
+	return authenticators, nil
+}
+
+// guard builds the guard, expanding "default" in Deny.
+func (g *guardConfig) guard() (*gator.Guard, error) {
+	guard := new(gator.Guard)
+	for i, s := range g.Deny {
+		if strings.TrimSpace(s) == "default" {
+			guard.Deny = append(guard.Deny, gator.DefaultDeny...)
+			continue
+		}
+		networks, err := gator.ParseNetworks(s)
+		if err != nil {
+			return nil, fmt.Errorf("guard.deny[%d]: %s", i, err)
+		}
+		guard.Deny = append(guard.Deny, networks...)
+	}
+	for i, s := range g.Allow {
+		networks, err := gator.ParseNetworks(s)
+		if err != nil {
+			return nil, fmt.Errorf("guard.allow[%d]: %s", i, err)
+		}
+		guard.Allow = append(guard.Allow, networks...)
+	}
+	return guard, nil
+}
+
+func (l *listenerConfig) network() string {
+	if l.Network == "" {
+		return "tcp"
+	}
+	return l.Network
+}
+
+// key identifies the socket of the listener across reloads.
+func (l *listenerConfig) key() string {
+	return l.network() + " " + l.Address
+}
+
+// mode returns the permissions of a Unix socket, 0 to leave them as the
+// umask made them.
+func (l *listenerConfig) mode() (os.FileMode, error) {
+	if l.Mode == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(l.Mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid permissions %q", l.Mode)
+	}
+	return os.FileMode(m), nil
+}
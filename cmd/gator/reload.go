@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/winxxp/gator"
+)
+
+// proxy accepts connections on the listeners of the configuration in force
+// and hands them to the server of their listener. Applying a new
+// configuration replaces the servers for new connections only, sessions in
+// progress stay with the server they started on until they finish.
+type proxy struct {
+	mu        sync.Mutex
+	listeners map[string]*listener
+	servers   []*gator.Server
+	logFile   *os.File
+
+	// draining holds the servers of earlier configurations until their
+	// last session ends.
+	draining map[*gator.Server]bool
+
+	// stopMonitor stops the health probes of the configuration in force.
+	stopMonitor context.CancelFunc
+}
+
+// listener is a socket and the server for the connections it accepts.
+type listener struct {
+	net.Listener
+	server *gator.Server
+}
+
+// apply makes cfg, with the servers built from it, the configuration in
+// force. It opens the listeners cfg adds before closing the ones it
+// removes, and changes nothing if one of them cannot be opened.
+func (p *proxy) apply(cfg *config, servers []*gator.Server) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	listeners := make(map[string]*listener)
+	var added []*listener
+	closeAdded := func() {
+		for _, l := range added {
+			l.Close()
+		}
+	}
+	for i, lc := range cfg.Listeners {
+		if l, ok := p.listeners[lc.key()]; ok {
+			listeners[lc.key()] = l
+			continue
+		}
+		ln, err := listen(&lc)
+		if err != nil {
+			closeAdded()
+			return err
+		}
+		l := &listener{Listener: ln, server: servers[i]}
+		listeners[lc.key()] = l
+		added = append(added, l)
+	}
+
+	if err := p.setLog(cfg.Log.File); err != nil {
+		closeAdded()
+		return err
+	}
+
+	for key, l := range p.listeners {
+		if _, ok := listeners[key]; !ok {
+			l.Close()
+			log.Printf("Stopped listening on %s", l.Addr())
+		}
+	}
+	for i, lc := range cfg.Listeners {
+		listeners[lc.key()].server = servers[i]
+	}
+	for _, l := range added {
+		log.Printf("Listening for new connections on %s", l.Addr())
+		go p.accept(l)
+	}
+
+	p.listeners = listeners
+	for _, srv := range p.servers {
+		p.retire(srv)
+	}
+	p.servers = servers
+	p.monitor(servers)
+	return nil
+}
+
+// retire shuts down srv, which no listener hands connections to any more,
+// and forgets it once its last session has ended.
+func (p *proxy) retire(srv *gator.Server) {
+	if p.draining == nil {
+		p.draining = make(map[*gator.Server]bool)
+	}
+	p.draining[srv] = true
+
+	go func() {
+		srv.Shutdown(context.Background())
+		p.mu.Lock()
+		delete(p.draining, srv)
+		p.mu.Unlock()
+	}()
+}
+
+// monitor starts the health probes of the upstream pools of servers, and
+// stops those of the previous configuration.
+func (p *proxy) monitor(servers []*gator.Server) {
+	if p.stopMonitor != nil {
+		p.stopMonitor()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.stopMonitor = cancel
+
+	seen := make(map[*gator.Pool]bool)
+	for _, srv := range servers {
+		for _, pool := range pools(srv.Dialer) {
+			if !seen[pool] {
+				seen[pool] = true
+				go pool.Monitor(ctx)
+			}
+		}
+	}
+}
+
+// listen opens the socket of a listener. A Unix socket left behind by a
+// process that did not exit cleanly is removed first, one that is still
+// accepting connections is not.
+func listen(lc *listenerConfig) (net.Listener, error) {
+	if lc.network() != "unix" {
+		return net.Listen(lc.network(), lc.Address)
+	}
+
+	if fi, err := os.Lstat(lc.Address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", lc.Address); err == nil {
+			c.Close()
+		} else {
+			os.Remove(lc.Address)
+		}
+	}
+
+	ln, err := net.Listen("unix", lc.Address)
+	if err != nil {
+		return nil, err
+	}
+	if mode, _ := lc.mode(); mode != 0 {
+		if err := os.Chmod(lc.Address, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// setLog directs the log to file, standard error if empty.
+func (p *proxy) setLog(file string) error {
+	if p.logFile != nil && p.logFile.Name() == file {
+		return nil
+	}
+
+	var f *os.File
+	if file != "" {
+		var err error
+		if f, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+
+	if p.logFile != nil {
+		p.logFile.Close()
+	}
+	p.logFile = f
+	return nil
+}
+
+// server returns the server for new connections on l.
+func (p *proxy) server(l *listener) *gator.Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return l.server
+}
+
+func (p *proxy) accept(l *listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to accept connection - error: %s", err.Error())
+			continue
+		}
+		go p.serve(l, p.server(l), conn)
+	}
+}
+
+// serve hands conn, accepted on l, to srv. A server that a reload retired
+// after it was chosen refuses conn, which then goes to the server that
+// replaced it on l.
+func (p *proxy) serve(l *listener, srv *gator.Server, conn net.Conn) {
+	for srv.ServeConn(conn) == gator.ErrServerClosed {
+		next := p.server(l)
+		if next == srv {
+			conn.Close()
+			return
+		}
+		srv = next
+	}
+}
+
+// shutdown stops accepting connections and shuts down the servers of the
+// configuration in force and those still draining, returning how many
+// sessions were cut when ctx expired.
+func (p *proxy) shutdown(ctx context.Context) (int, error) {
+	p.mu.Lock()
+	for _, l := range p.listeners {
+		l.Close()
+	}
+	p.listeners = nil
+	if p.stopMonitor != nil {
+		p.stopMonitor()
+	}
+	servers := append([]*gator.Server(nil), p.servers...)
+	for srv := range p.draining {
+		servers = append(servers, srv)
+	}
+	p.mu.Unlock()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		cut      int
+		firstErr error
+	)
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *gator.Server) {
+			defer wg.Done()
+			n, err := s.Shutdown(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			cut += n
+			if firstErr == nil {
+				firstErr = err
+			}
+		}(s)
+	}
+	wg.Wait()
+	return cut, firstErr
+}
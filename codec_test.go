@@ -0,0 +1,274 @@
+package gator
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"testing/quick"
+)
+
+// codec is a message with both directions of its wire format.
+type codec interface {
+	ReadBinary(r io.Reader) error
+	WriteBinary(w io.Writer) error
+}
+
+// checkCodec reads a message from data and checks that
+//   - a failure is a *ProtocolError,
+//   - reading one byte at a time gives the same result,
+//   - WriteBinary writes as many bytes as ReadBinary consumed, and
+//   - reading that back gives the same message and the same bytes.
+//
+// skip is the length of the version number that WriteBinary writes but
+// ReadBinary expects to have been read already.
+func checkCodec(t *testing.T, data []byte, newMessage func() codec, skip int) {
+	r := bytes.NewReader(data)
+	m := newMessage()
+	err := m.ReadBinary(r)
+
+	split := newMessage()
+	splitErr := split.ReadBinary(iotest.OneByteReader(bytes.NewReader(data)))
+	if (err == nil) != (splitErr == nil) {
+		t.Fatalf("ReadBinary(% x) = %v, one byte at a time %v", data, err, splitErr)
+	}
+
+	if err != nil {
+		var pe *ProtocolError
+		if !errors.As(err, &pe) {
+			t.Fatalf("ReadBinary(% x) = %v, want a *ProtocolError", data, err)
+		}
+		return
+	}
+	if !reflect.DeepEqual(m, split) {
+		t.Fatalf("ReadBinary(% x) = %+v, one byte at a time %+v", data, m, split)
+	}
+	consumed := len(data) - r.Len()
+
+	var first bytes.Buffer
+	if err := m.WriteBinary(&first); err != nil {
+		t.Fatalf("WriteBinary(%+v): %s", m, err)
+	}
+	if first.Len()-skip != consumed {
+		t.Fatalf("WriteBinary(%+v) wrote %d bytes, ReadBinary consumed %d", m, first.Len()-skip, consumed)
+	}
+
+	again := newMessage()
+	if err := again.ReadBinary(bytes.NewReader(first.Bytes()[skip:])); err != nil {
+		t.Fatalf("ReadBinary(% x): %s", first.Bytes(), err)
+	}
+	var second bytes.Buffer
+	if err := again.WriteBinary(&second); err != nil {
+		t.Fatalf("WriteBinary(%+v): %s", again, err)
+	}
+	if !reflect.DeepEqual(m, again) || !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatalf("round trip of % x changed %+v to %+v", data, m, again)
+	}
+}
+
+func FuzzMethod5Request(f *testing.F) {
+	f.Add([]byte{0x01, 0x00})
+	f.Add([]byte{0x02, 0x00, 0x02})
+	f.Add([]byte{0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkCodec(t, data, func() codec { return new(Method5Request) }, 1)
+	})
+}
+
+func FuzzMethod5Reply(f *testing.F) {
+	f.Add([]byte{0x05, 0x00})
+	f.Add([]byte{0x05, 0xFF})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkCodec(t, data, func() codec { return new(Method5Reply) }, 0)
+	})
+}
+
+func FuzzAuth5Request(f *testing.F) {
+	f.Add([]byte{0x01, 0x05, 'a', 'l', 'i', 'c', 'e', 0x06, 's', 'e', 'c', 'r', 'e', 't'})
+	f.Add([]byte{0x01, 0x00, 0x00})
+	f.Add([]byte{0x05, 0x01, 'a', 0x01, 'b'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkCodec(t, data, func() codec { return new(Auth5Request) }, 0)
+	})
+}
+
+func FuzzAuth5Reply(f *testing.F) {
+	f.Add([]byte{0x01, 0x00})
+	f.Add([]byte{0x01, 0x01})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkCodec(t, data, func() codec { return new(Auth5Reply) }, 0)
+	})
+}
+
+func FuzzSocks5Request(f *testing.F) {
+	f.Add([]byte{0x05, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0x00, 0x50})
+	f.Add([]byte{0x05, 0x01, 0x00, 0x03, 0x0b, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x01, 0xbb})
+	f.Add([]byte{0x05, 0x03, 0x00, 0x04, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x35})
+	f.Add([]byte{0x05, 0x02, 0x00, 0x02, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkCodec(t, data, func() codec { return new(Socks5Request) }, 0)
+	})
+}
+
+func FuzzSocks5Reply(f *testing.F) {
+	f.Add([]byte{0x05, 0x00, 0x00, 0x01, 198, 51, 100, 10, 0x10, 0x92})
+	f.Add([]byte{0x05, 0x04, 0x00, 0x03, 0x00, 0x00, 0x00})
+	f.Add([]byte{0x05, 0x00, 0x00, 0x04, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x99, 0x10, 0x92})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkCodec(t, data, func() codec { return new(Socks5Reply) }, 0)
+	})
+}
+
+func FuzzSocks5UDPRequest(f *testing.F) {
+	f.Add([]byte{0x00, 0x00, 0x00, 0x01, 192, 0, 2, 1, 0x00, 0x35, 'd', 'n', 's'})
+	f.Add([]byte{0x00, 0x00, 0x01, 0x03, 0x01, 'a', 0x00, 0x35})
+	f.Add([]byte{0x00, 0x01, 0x00, 0x01})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkCodec(t, data, func() codec { return new(Socks5UDPRequest) }, 0)
+	})
+}
+
+func FuzzSocks4Request(f *testing.F) {
+	f.Add([]byte{0x01, 0x00, 0x50, 192, 0, 2, 1, 'a', 'l', 'i', 'c', 'e', 0x00})
+	f.Add([]byte{0x01, 0x00, 0x50, 0, 0, 0, 1, 0x00, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x00})
+	f.Add([]byte{0x02, 0x00, 0x00, 0, 0, 0, 0, 0x00})
+	f.Add([]byte{0x01, 0x00, 0x50, 0, 0, 0, 1, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkCodec(t, data, func() codec { return new(Socks4Request) }, 1)
+	})
+}
+
+func FuzzSocks4Reply(f *testing.F) {
+	f.Add([]byte{0x00, 90, 0x10, 0x92, 198, 51, 100, 10})
+	f.Add([]byte{0x00, 91, 0x00, 0x00, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkCodec(t, data, func() codec { return new(Socks4Reply) }, 0)
+	})
+}
+
+// roundTrip writes m and reads it back into a new message.
+func roundTrip(m codec, newMessage func() codec, skip int) (codec, error) {
+	var buf bytes.Buffer
+	if err := m.WriteBinary(&buf); err != nil {
+		return nil, err
+	}
+	got := newMessage()
+	if err := got.ReadBinary(bytes.NewReader(buf.Bytes()[skip:])); err != nil {
+		return nil, err
+	}
+	return got, nil
+}
+
+// quickAddress picks an ATYP and fills in the matching address fields.
+func quickAddress(atyp byte, ip [16]byte, domain string) (byte, net.IP, string) {
+	switch atyp % 3 {
+	case 0:
+		return 0x01, net.IP(ip[:4]), ""
+	case 1:
+		if domain == "" {
+			domain = "a"
+		}
+		if len(domain) > 255 {
+			domain = domain[:255]
+		}
+		return 0x03, nil, domain
+	}
+	return 0x04, net.IP(ip[:]), ""
+}
+
+func TestSocks5RequestRoundTrip(t *testing.T) {
+	f := func(cmd, atyp byte, ip [16]byte, domain string, port uint16) bool {
+		m := &Socks5Request{Version: 0x05, Command: 1 + cmd%3, Port: port}
+		m.AddressType, m.Address, m.Domain = quickAddress(atyp, ip, domain)
+
+		got, err := roundTrip(m, func() codec { return new(Socks5Request) }, 0)
+		return err == nil && reflect.DeepEqual(got, m)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSocks5ReplyRoundTrip(t *testing.T) {
+	f := func(rep, atyp byte, ip [16]byte, domain string, port uint16) bool {
+		m := &Socks5Reply{Version: 0x05, Reply: rep, Port: port}
+		m.AddressType, m.Address, m.Domain = quickAddress(atyp, ip, domain)
+
+		got, err := roundTrip(m, func() codec { return new(Socks5Reply) }, 0)
+		return err == nil && reflect.DeepEqual(got, m)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSocks5UDPRequestRoundTrip(t *testing.T) {
+	f := func(frag, atyp byte, ip [16]byte, domain string, port uint16, data []byte) bool {
+		m := &Socks5UDPRequest{Frag: frag, Port: port, Data: append([]byte{}, data...)}
+		m.AddressType, m.Address, m.Domain = quickAddress(atyp, ip, domain)
+
+		got, err := roundTrip(m, func() codec { return new(Socks5UDPRequest) }, 0)
+		return err == nil && reflect.DeepEqual(got, m)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuth5RequestRoundTrip(t *testing.T) {
+	f := func(username, password string) bool {
+		if len(username) > 255 || len(password) > 255 || username == "" || password == "" {
+			return true
+		}
+		m := &Auth5Request{Version: 0x01, Username: username, Password: password}
+
+		got, err := roundTrip(m, func() codec { return new(Auth5Request) }, 0)
+		return err == nil && reflect.DeepEqual(got, m)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSocks4RequestRoundTrip(t *testing.T) {
+	f := func(cmd byte, ip [4]byte, userid, domain string, port uint16) bool {
+		userid = strings.ReplaceAll(userid, "\x00", "")
+		domain = strings.ReplaceAll(domain, "\x00", "")
+		if len(userid) > maxStringLength || len(domain) > maxStringLength {
+			return true
+		}
+
+		m := &Socks4Request{Command: 1 + cmd%2, Address: net.IP(ip[:]), Port: port, Domain: domain}
+		if userid != "" {
+			m.UserID = []byte(userid)
+		}
+		if domain != "" && !isSocks4A(m.Address) {
+			m.Address = net.IPv4(0, 0, 0, 1).To4()
+		}
+		if domain == "" && isSocks4A(m.Address) {
+			m.Address = net.IPv4zero.To4()
+		}
+
+		got, err := roundTrip(m, func() codec { return new(Socks4Request) }, 1)
+		return err == nil && reflect.DeepEqual(got, m)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSocks4ReplyRoundTrip(t *testing.T) {
+	f := func(cd byte, ip [4]byte, port uint16) bool {
+		m := &Socks4Reply{Command: cd, Port: port, Address: net.IP(ip[:])}
+
+		got, err := roundTrip(m, func() codec { return new(Socks4Reply) }, 0)
+		return err == nil && reflect.DeepEqual(got, m)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,224 @@
+package gator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The conformance suite replays the transcripts in testdata/conformance
+// against Server.ServeConn over a net.Pipe. A transcript has one step per
+// line:
+//
+//	> 05 01 00      the client sends these bytes
+//	< 05 00         the server must answer with exactly these bytes
+//	< EOF           the server must close the connection
+//	dial host:port  the server must have dialed this address
+//
+// Bytes are written in hex, or as Go quoted strings such as "example.com".
+// Blank lines and lines starting with # are ignored.
+//
+// The server accepts alice:secret with username/password and anyone else
+// without authentication, and denies port 25. Its dialer refuses port 1,
+// cannot resolve nx.invalid and connects anything else to an echo server.
+// Those connections report 198.51.100.10:4242 as their local address, or
+// [2001:db8::99]:4242 for IPv6 destinations.
+
+// pipeDialer connects to an in-memory echo server and records every address
+// it is asked for.
+type pipeDialer struct {
+	mu     sync.Mutex
+	dialed []string
+}
+
+// localAddrConn is a net.Conn with a fixed local address.
+type localAddrConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c *localAddrConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, address)
+	d.mu.Unlock()
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case port == "1":
+		return nil, dialError(syscall.ECONNREFUSED)
+	case host == "nx.invalid":
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}}
+	}
+
+	local := &net.TCPAddr{IP: net.ParseIP("198.51.100.10"), Port: 4242}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		local.IP = net.ParseIP("2001:db8::99")
+	}
+
+	conn, echo := net.Pipe()
+	go func() {
+		defer echo.Close()
+		io.Copy(echo, echo)
+	}()
+	return &localAddrConn{Conn: conn, local: local}, nil
+}
+
+// denyPort is a RuleSet that denies a single destination port.
+type denyPort int
+
+func (p denyPort) Allow(r *Request) bool {
+	return r.Port != int(p)
+}
+
+func TestConformance(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "conformance", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no transcripts found")
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".txt")
+		t.Run(name, func(t *testing.T) {
+			runTranscript(t, file)
+		})
+	}
+}
+
+func runTranscript(t *testing.T, file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dialer := new(pipeDialer)
+	s := &Server{
+		Dialer: dialer,
+		Authenticators: []Authenticator{
+			&UserPassAuth{Credentials: StaticCredentials{"alice": "secret"}},
+			NoAuth{},
+		},
+		Rules:            denyPort(25),
+		Logger:           log.New(io.Discard, "", 0),
+		HandshakeTimeout: 5 * time.Second,
+	}
+
+	client, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeConn(conn)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var dials []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		step, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			step, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch step {
+		case ">":
+			b := parseBytes(t, file, n, arg)
+			if _, err := client.Write(b); err != nil {
+				t.Fatalf("%s:%d: write: %s", file, n, err)
+			}
+		case "<":
+			if arg == "EOF" {
+				if b, err := io.ReadAll(client); err != nil || len(b) > 0 {
+					t.Fatalf("%s:%d: got % x, %v, want EOF", file, n, b, err)
+				}
+				continue
+			}
+			want := parseBytes(t, file, n, arg)
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(client, got); err != nil {
+				t.Fatalf("%s:%d: read: %s, want % x", file, n, err, want)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%s:%d: got % x, want % x", file, n, got, want)
+			}
+		case "dial":
+			dials = append(dials, arg)
+		default:
+			t.Fatalf("%s:%d: unknown step %q", file, n, step)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn did not return")
+	}
+
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	if (len(dialer.dialed) > 0 || len(dials) > 0) && !reflect.DeepEqual(dialer.dialed, dials) {
+		t.Errorf("dialed %q, want %q", dialer.dialed, dials)
+	}
+}
+
+// parseBytes parses the bytes of a step, written in hex or as Go quoted
+// strings.
+func parseBytes(t *testing.T, file string, n int, s string) []byte {
+	t.Helper()
+	var b []byte
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		if s[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				t.Fatalf("%s:%d: %s", file, n, err)
+			}
+			unquoted, _ := strconv.Unquote(quoted)
+			b = append(b, unquoted...)
+			s = s[len(quoted):]
+			continue
+		}
+
+		field := s
+		if i := strings.IndexAny(s, ` "`); i >= 0 {
+			field = s[:i]
+		}
+		decoded, err := hex.DecodeString(field)
+		if err != nil {
+			t.Fatalf("%s:%d: %s", file, n, err)
+		}
+		b = append(b, decoded...)
+		s = s[len(field):]
+	}
+	return b
+}
@@ -0,0 +1,407 @@
+package gator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// AddressFamily is which addresses of a destination a DirectDialer connects
+// to, and in which order.
+type AddressFamily int
+
+// Address families of a DirectDialer.
+const (
+	// HappyEyeballs races the IPv6 and IPv4 addresses as RFC 8305 does:
+	// IPv6 first, then an address of the other family every Stagger or as
+	// soon as an attempt fails, until one connects.
+	HappyEyeballs AddressFamily = iota
+
+	// PreferIPv4 and PreferIPv6 try the addresses of one family, then
+	// those of the other, one at a time.
+	PreferIPv4
+	PreferIPv6
+
+	// IPv4Only and IPv6Only only connect to addresses of one family.
+	IPv4Only
+	IPv6Only
+)
+
+var familyNames = []string{"happy-eyeballs", "prefer-v4", "prefer-v6", "v4-only", "v6-only"}
+
+func (f AddressFamily) String() string {
+	if int(f) < len(familyNames) {
+		return familyNames[f]
+	}
+	return fmt.Sprintf("AddressFamily(%d)", int(f))
+}
+
+// ParseAddressFamily parses happy-eyeballs, prefer-v4, prefer-v6, v4-only
+// or v6-only.
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	for i, name := range familyNames {
+		if s == name {
+			return AddressFamily(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown address family %q", s)
+}
+
+// allows reports whether f connects to ip at all.
+func (f AddressFamily) allows(ip net.IP) bool {
+	switch f {
+	case IPv4Only:
+		return ip.To4() != nil
+	case IPv6Only:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// order returns the addresses f connects to, in the order to try them. The
+// order of the resolver is kept within each family.
+func (f AddressFamily) order(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch f {
+	case PreferIPv4:
+		return append(v4, v6...)
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	case PreferIPv6:
+		return append(v6, v4...)
+	}
+	// Alternate, IPv6 first.
+	var order []net.IP
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			order = append(order, v6[i])
+		}
+		if i < len(v4) {
+			order = append(order, v4[i])
+		}
+	}
+	return order
+}
+
+// Delays of HappyEyeballs, RFC 8305.
+const (
+	// defaultStagger is the Connection Attempt Delay of section 5.
+	defaultStagger = 250 * time.Millisecond
+
+	// resolutionDelay is how long the IPv4 addresses wait for the IPv6
+	// ones, section 3.
+	resolutionDelay = 50 * time.Millisecond
+)
+
+// Egress is where connections leave the host from, on a host with several
+// addresses or interfaces. The zero Egress leaves the choice to the system.
+type Egress struct {
+	// LocalAddr is the source address of the connections. Only destination
+	// addresses of its family can be reached from it.
+	LocalAddr net.IP
+
+	// Interface is the name of the network interface the connections are
+	// bound to, with SO_BINDTODEVICE, whatever the routing table says.
+	// Linux only.
+	Interface string
+}
+
+// isZero reports whether e leaves the choice to the system.
+func (e Egress) isZero() bool {
+	return e.LocalAddr == nil && e.Interface == ""
+}
+
+// dialer returns a net.Dialer that connects over network from e, calling
+// control after binding the socket to the interface of e.
+func (e Egress) dialer(network string, control func(network, address string, c syscall.RawConn) error) *net.Dialer {
+	d := &net.Dialer{Control: control}
+	if e.LocalAddr != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: e.LocalAddr}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: e.LocalAddr}
+		}
+	}
+	if e.Interface != "" {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			if err := bindToDevice(c, e.Interface); err != nil {
+				return fmt.Errorf("bind to %s: %w", e.Interface, err)
+			}
+			if control != nil {
+				return control(network, address, c)
+			}
+			return nil
+		}
+	}
+	return d
+}
+
+// listenUDP opens a UDP socket that sends from e, on a port the system
+// chooses.
+func (e Egress) listenUDP() (*net.UDPConn, error) {
+	network, address := "udp", ":0"
+	if e.LocalAddr != nil {
+		network, address = "udp6", net.JoinHostPort(e.LocalAddr.String(), "0")
+		if e.LocalAddr.To4() != nil {
+			network = "udp4"
+		}
+	}
+	lc := &net.ListenConfig{Control: e.dialer(network, nil).Control}
+	pc, err := lc.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// family returns the address family f is narrowed to from e: a source
+// address can only reach destinations of its own family.
+func (e Egress) family(f AddressFamily) AddressFamily {
+	switch {
+	case e.LocalAddr == nil:
+		return f
+	case e.LocalAddr.To4() != nil:
+		return IPv4Only
+	}
+	return IPv6Only
+}
+
+type egressKey struct{}
+
+// withEgress returns a copy of ctx that makes the dialers of this package
+// connect from e, unless e is zero.
+func withEgress(ctx context.Context, e Egress) context.Context {
+	if e.isZero() {
+		return ctx
+	}
+	return context.WithValue(ctx, egressKey{}, e)
+}
+
+// egressOf returns the Egress of ctx, or e if ctx has none.
+func egressOf(ctx context.Context, e Egress) Egress {
+	if ctxEgress, ok := ctx.Value(egressKey{}).(Egress); ok {
+		return ctxEgress
+	}
+	return e
+}
+
+// DirectDialer connects to destinations itself, resolving their domain
+// names with Resolver and choosing among their addresses by Family.
+type DirectDialer struct {
+	// Resolver resolves domain names, the system resolver if nil.
+	Resolver Resolver
+
+	// Family chooses the addresses to connect to, HappyEyeballs if zero.
+	Family AddressFamily
+
+	// Stagger is the time between the attempts of HappyEyeballs, 250
+	// milliseconds if zero.
+	Stagger time.Duration
+
+	// Egress is where the connections leave from, unless the Server that
+	// dials sets another for the request.
+	Egress Egress
+
+	// Control is passed to the net.Dialer of every connection, such as
+	// Guard.Control to check the addresses.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+func (d *DirectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	egress := egressOf(ctx, d.Egress)
+	dialer := egress.dialer(network, d.Control)
+
+	family := egress.family(d.Family)
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return dialer.DialContext(ctx, network, address)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !family.allows(ip) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("%w: %s is not %s", ErrAddressType, ip, family)}
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	lookup := ipNetwork(network)
+	switch {
+	case lookup == "ip" && family == HappyEyeballs:
+		return d.happyEyeballs(ctx, dialer, network, host, port)
+	case lookup == "ip" && family == IPv4Only:
+		lookup = "ip4"
+	case lookup == "ip" && family == IPv6Only:
+		lookup = "ip6"
+	}
+
+	ips, err := lookupIP(ctx, d.Resolver, lookup, host)
+	if err == nil {
+		if ips = family.order(ips); len(ips) == 0 {
+			err = fmt.Errorf("%w: %s has no %s address", ErrAddressType, host, family)
+		}
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	var first error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if first == nil {
+			first = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, first
+}
+
+// happyEyeballs resolves the IPv6 and IPv4 addresses of host concurrently
+// and races connections to them. Attempts start with the first IPv6
+// address, or with an IPv4 one if the IPv6 addresses are not known
+// resolutionDelay after them, and alternate between the families. Addresses
+// resolved late join the race.
+func (d *DirectDialer) happyEyeballs(ctx context.Context, dialer *net.Dialer, network, host, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stagger := d.Stagger
+	if stagger == 0 {
+		stagger = defaultStagger
+	}
+
+	type answer struct {
+		ips []net.IP
+		err error
+	}
+	lookup := func(family string) <-chan answer {
+		ch := make(chan answer, 1)
+		go func() {
+			ips, err := lookupIP(ctx, d.Resolver, family, host)
+			ch <- answer{ips, err}
+		}()
+		return ch
+	}
+	v6, v4 := lookup("ip6"), lookup("ip4")
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result)
+	pending, attempts := 0, 0
+	defer func() {
+		// Close the connections of the attempts that lost.
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}(pending)
+	}()
+
+	var q6, q4 []net.IP
+	var lookupErr, dialErr error
+	var resolved, staggered <-chan time.Time
+	last6, waited, due := false, false, true
+	for {
+		// Start the next attempt when it is due and an address is ready.
+		ready4 := len(q4) > 0 && (attempts > 0 || v6 == nil || waited)
+		var ip net.IP
+		switch {
+		case !due:
+		case len(q6) > 0 && (!last6 || !ready4):
+			ip, q6, last6 = q6[0], q6[1:], true
+		case ready4:
+			ip, q4, last6 = q4[0], q4[1:], false
+		}
+		if ip != nil {
+			pending++
+			attempts++
+			due = false
+			staggered = time.After(stagger)
+			go func(address string) {
+				conn, err := dialer.DialContext(ctx, network, address)
+				results <- result{conn, err}
+			}(net.JoinHostPort(ip.String(), port))
+		}
+
+		if pending == 0 && v6 == nil && v4 == nil && len(q6)+len(q4) == 0 {
+			if dialErr == nil {
+				dialErr = lookupErr
+			}
+			return nil, &net.OpError{Op: "dial", Net: network, Err: dialErr}
+		}
+
+		select {
+		case a := <-v6:
+			v6 = nil
+			q6 = append(q6, a.ips...)
+			lookupErr = lookupError(lookupErr, a.err)
+		case a := <-v4:
+			v4 = nil
+			q4 = append(q4, a.ips...)
+			lookupErr = lookupError(lookupErr, a.err)
+			if v6 != nil && attempts == 0 {
+				resolved = time.After(resolutionDelay)
+			}
+		case <-resolved:
+			resolved, waited = nil, true
+		case <-staggered:
+			staggered, due = nil, true
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			if dialErr == nil {
+				dialErr = r.err
+			}
+			// A failed attempt makes way for the next at once.
+			staggered, due = nil, true
+		case <-ctx.Done():
+			return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+		}
+	}
+}
+
+// lookupError returns the error to report of two lookups, the first found
+// error or err: a failure rather than a name not found.
+func lookupError(found, err error) error {
+	if found == nil {
+		return err
+	}
+	if dnsErr, ok := found.(*net.DNSError); ok && dnsErr.IsNotFound && err != nil {
+		return err
+	}
+	return found
+}
+
+// ipNetwork returns the address family a dial over network needs.
+func ipNetwork(network string) string {
+	switch network {
+	case "tcp4", "udp4":
+		return "ip4"
+	case "tcp6", "udp6":
+		return "ip6"
+	}
+	return "ip"
+}
@@ -0,0 +1,17 @@
+package gator
+
+import (
+	"os"
+	"syscall"
+)
+
+// bindToDevice binds the socket of c to the network interface name.
+func bindToDevice(c syscall.RawConn, name string) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+	}); cerr != nil {
+		return cerr
+	}
+	return os.NewSyscallError("setsockopt", err)
+}
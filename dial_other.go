@@ -0,0 +1,13 @@
+//go:build !linux
+
+package gator
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToDevice fails, only Linux binds sockets to interfaces.
+func bindToDevice(c syscall.RawConn, name string) error {
+	return errors.New("binding to an interface is only supported on Linux")
+}
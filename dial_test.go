@@ -0,0 +1,320 @@
+package gator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// familyResolver answers with the IPv4 and IPv6 loopback addresses, each
+// after its own delay.
+type familyResolver struct {
+	delay4, delay6 time.Duration
+}
+
+func (r *familyResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	var ips []net.IP
+	if network != "ip4" {
+		time.Sleep(r.delay6)
+		ips = append(ips, net.IPv6loopback)
+	}
+	if network != "ip6" {
+		time.Sleep(r.delay4)
+		ips = append(ips, net.IPv4(127, 0, 0, 1))
+	}
+	return ips, nil
+}
+
+// listenDual listens on the same port of both loopback addresses and
+// returns the port and a channel that the family of each connection
+// accepted is sent to. The test is skipped without IPv6.
+func listenDual(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		ln4 := listenLoopback(t, "tcp4")
+		_, port, _ := net.SplitHostPort(ln4.Addr().String())
+		ln6, err := net.Listen("tcp6", net.JoinHostPort("::1", port))
+		if err != nil {
+			ln4.Close()
+			ln6, err := net.Listen("tcp6", "[::1]:0")
+			if err != nil {
+				t.Skipf("tcp6 loopback unavailable: %s", err)
+			}
+			ln6.Close()
+			continue
+		}
+		t.Cleanup(func() {
+			ln4.Close()
+			ln6.Close()
+		})
+
+		accepted := make(chan string, 10)
+		for family, ln := range map[string]net.Listener{"v4": ln4, "v6": ln6} {
+			go func(family string, ln net.Listener) {
+				for {
+					c, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					c.Close()
+					accepted <- family
+				}
+			}(family, ln)
+		}
+		return port, accepted
+	}
+	t.Skip("no port free on both loopback addresses")
+	return "", nil
+}
+
+func TestAddressFamilyOrder(t *testing.T) {
+	a4, b4 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	a6, b6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	ips := []net.IP{a4, b4, a6, b6}
+
+	tests := []struct {
+		family AddressFamily
+		want   []net.IP
+	}{
+		{HappyEyeballs, []net.IP{a6, a4, b6, b4}},
+		{PreferIPv4, []net.IP{a4, b4, a6, b6}},
+		{PreferIPv6, []net.IP{a6, b6, a4, b4}},
+		{IPv4Only, []net.IP{a4, b4}},
+		{IPv6Only, []net.IP{a6, b6}},
+	}
+	for _, tt := range tests {
+		if got := tt.family.order(ips); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: order = %v, want %v", tt.family, got, tt.want)
+		}
+		if f, err := ParseAddressFamily(tt.family.String()); f != tt.family || err != nil {
+			t.Errorf("ParseAddressFamily(%q) = %v, %v", tt.family, f, err)
+		}
+	}
+	if _, err := ParseAddressFamily("v5-only"); err == nil {
+		t.Error("ParseAddressFamily(v5-only) succeeded")
+	}
+}
+
+func TestDirectDialerFamily(t *testing.T) {
+	port, accepted := listenDual(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for family, want := range map[AddressFamily]string{
+		HappyEyeballs: "v6",
+		PreferIPv4:    "v4",
+		PreferIPv6:    "v6",
+		IPv4Only:      "v4",
+		IPv6Only:      "v6",
+	} {
+		d := &DirectDialer{Resolver: &familyResolver{}, Family: family}
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort("dual.test", port))
+		if err != nil {
+			t.Fatalf("%s: %s", family, err)
+		}
+		conn.Close()
+		if got := <-accepted; got != want {
+			t.Errorf("%s: connected over %s, want %s", family, got, want)
+		}
+	}
+
+	// Addresses of the other family are not connected to.
+	d := &DirectDialer{Family: IPv6Only}
+	if _, err := d.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", port)); replyCode5(err) != 0x08 {
+		t.Errorf("v6-only dial of an IPv4 address = %v", err)
+	}
+	d.Resolver = &HostsResolver{Hosts: map[string][]net.IP{"v4.test": {net.IPv4(127, 0, 0, 1)}}}
+	if _, err := d.DialContext(ctx, "tcp", net.JoinHostPort("v4.test", port)); replyCode5(err) != 0x04 {
+		t.Errorf("v6-only dial of an IPv4 host = %v", err)
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	port, accepted := listenDual(t)
+	address := net.JoinHostPort("dual.test", port)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dial := func(d *DirectDialer, want string, within time.Duration) {
+		t.Helper()
+		start := time.Now()
+		conn, err := d.DialContext(ctx, "tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if elapsed := time.Since(start); elapsed > within {
+			t.Errorf("connected after %s, want within %s", elapsed, within)
+		}
+		if got := <-accepted; got != want {
+			t.Errorf("connected over %s, want %s", got, want)
+		}
+	}
+
+	// IPv6 that hangs gives way to IPv4 after Stagger.
+	hang6 := func(network, address string, c syscall.RawConn) error {
+		if network == "tcp6" {
+			time.Sleep(time.Second)
+			return errors.New("blackholed")
+		}
+		return nil
+	}
+	dial(&DirectDialer{Resolver: &familyResolver{}, Stagger: 50 * time.Millisecond, Control: hang6}, "v4", 500*time.Millisecond)
+
+	// IPv6 that fails gives way to IPv4 at once.
+	refuse6 := func(network, address string, c syscall.RawConn) error {
+		if network == "tcp6" {
+			return syscall.ECONNREFUSED
+		}
+		return nil
+	}
+	dial(&DirectDialer{Resolver: &familyResolver{}, Stagger: time.Minute, Control: refuse6}, "v4", 500*time.Millisecond)
+
+	// IPv4 does not wait for IPv6 addresses resolved late, and IPv6 does
+	// not wait for IPv4 addresses.
+	dial(&DirectDialer{Resolver: &familyResolver{delay6: time.Second}}, "v4", 500*time.Millisecond)
+	dial(&DirectDialer{Resolver: &familyResolver{delay4: time.Second}}, "v6", 500*time.Millisecond)
+
+	// Every attempt fails.
+	_, err := (&DirectDialer{Resolver: &familyResolver{}, Control: refuse6}).DialContext(ctx, "tcp", net.JoinHostPort("dual.test", strconv.Itoa(1)))
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("got %v, want connection refused", err)
+	}
+}
+
+// listenSources listens on the IPv4 loopback address and returns its address
+// and a channel that the source address of every connection accepted is
+// sent to.
+func listenSources(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln := listenLoopback(t, "tcp4")
+	t.Cleanup(func() { ln.Close() })
+
+	sources := make(chan string, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			sources <- connIP(c.RemoteAddr()).String()
+			c.Close()
+		}
+	}()
+	return ln.Addr().String(), sources
+}
+
+// loopbackAlias returns ip, an address of the loopback network that the
+// test connects from, and skips the test when the host cannot bind it, as
+// only Linux binds all of 127.0.0.0/8.
+func loopbackAlias(t *testing.T, ip string) Egress {
+	t.Helper()
+	ln, err := net.Listen("tcp4", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Skipf("cannot bind %s: %s", ip, err)
+	}
+	ln.Close()
+	return Egress{LocalAddr: net.ParseIP(ip)}
+}
+
+func TestEgress(t *testing.T) {
+	addr, sources := listenSources(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	check := func(t *testing.T, want string) {
+		t.Helper()
+		select {
+		case got := <-sources:
+			if got != want {
+				t.Errorf("connected from %s, want %s", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatal("no connection")
+		}
+	}
+
+	// An IPv4 source cannot reach IPv6 destinations.
+	d := &DirectDialer{Egress: Egress{LocalAddr: net.ParseIP("192.0.2.1")}}
+	if _, err := d.DialContext(ctx, "tcp", "[::1]:80"); replyCode5(err) != 0x08 {
+		t.Errorf("dial of an IPv6 address from an IPv4 one = %v", err)
+	}
+
+	t.Run("source", func(t *testing.T) {
+		d := &DirectDialer{Egress: loopbackAlias(t, "127.0.0.2")}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		check(t, "127.0.0.2")
+
+		// The Egress of the context wins, and applies to upstreams too.
+		conn, err = d.DialContext(withEgress(ctx, loopbackAlias(t, "127.0.0.3")), "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		check(t, "127.0.0.3")
+		(&SOCKS5Dialer{Addr: addr}).DialContext(withEgress(ctx, loopbackAlias(t, "127.0.0.4")), "tcp", "example.com:80")
+		check(t, "127.0.0.4")
+	})
+
+	t.Run("interface", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("binding to an interface is only supported on Linux")
+		}
+		d := &DirectDialer{Egress: Egress{Interface: "lo"}}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if errors.Is(err, syscall.EPERM) {
+			// Before Linux 5.7, SO_BINDTODEVICE needs CAP_NET_RAW.
+			t.Skipf("cannot bind to an interface: %s", err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		check(t, "127.0.0.1")
+
+		d.Egress.Interface = "gator-none0"
+		if _, err := d.DialContext(ctx, "tcp", addr); !errors.Is(err, syscall.ENODEV) {
+			t.Errorf("dial bound to a missing interface = %v, want no such device", err)
+		}
+	})
+}
+
+func TestServerEgress(t *testing.T) {
+	addr, sources := listenSources(t)
+	proxy := serve(t, "tcp4", &Server{
+		Authenticators: []Authenticator{&UserPassAuth{Credentials: StaticCredentials{"alice": "secret"}}, NoAuth{}},
+		Guard:          allowLoopback,
+		Egress:         loopbackAlias(t, "127.0.0.2"),
+		UserEgress:     map[string]Egress{"alice": loopbackAlias(t, "127.0.0.3")},
+	}).String()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, tt := range []struct {
+		client Dialer
+		want   string
+	}{
+		{&SOCKS5Dialer{Addr: proxy}, "127.0.0.2"},
+		{&SOCKS5Dialer{Addr: proxy, Username: "alice", Password: "secret"}, "127.0.0.3"},
+		{&HTTPDialer{Addr: proxy, Username: "alice", Password: "secret"}, "127.0.0.3"},
+	} {
+		conn, err := tt.client.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.client, err)
+		}
+		conn.Close()
+		if got := <-sources; got != tt.want {
+			t.Errorf("%s: connected from %s, want %s", tt.client, got, tt.want)
+		}
+	}
+}
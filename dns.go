@@ -0,0 +1,531 @@
+package gator
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record types and response codes of the DNS messages the resolvers use.
+const (
+	dnsTypeA    = 1
+	dnsTypeSOA  = 6
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+)
+
+// dnsMessage is a DNS message of a single question, enough to look up
+// addresses. Only the records the resolvers need are decoded.
+type dnsMessage struct {
+	ID        uint16
+	Response  bool
+	Truncated bool
+	Rcode     byte
+
+	// Name and Type are those of the question, of class IN.
+	Name string
+	Type uint16
+
+	Answers   []dnsRecord
+	Authority []dnsRecord
+}
+
+// dnsRecord is a resource record. Data is the address of an A or AAAA
+// record, Minimum the MINIMUM field of a SOA record.
+type dnsRecord struct {
+	Name    string
+	Type    uint16
+	Class   uint16
+	TTL     uint32
+	Data    []byte
+	Minimum uint32
+}
+
+// ReadBinary reads a whole message from r, such as a UDP datagram.
+func (m *dnsMessage) ReadBinary(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(b) < 12 {
+		return &ProtocolError{Message: "dnsMessage", Err: ErrTruncated}
+	}
+
+	m.ID = binary.BigEndian.Uint16(b)
+	flags := binary.BigEndian.Uint16(b[2:])
+	m.Response = flags&0x8000 != 0
+	m.Truncated = flags&0x0200 != 0
+	m.Rcode = byte(flags & 0x000F)
+	qdcount := binary.BigEndian.Uint16(b[4:])
+	ancount := binary.BigEndian.Uint16(b[6:])
+	nscount := binary.BigEndian.Uint16(b[8:])
+	if qdcount != 1 {
+		return &ProtocolError{Message: "dnsMessage", Err: fmt.Errorf("%w: %d questions", ErrMalformed, qdcount)}
+	}
+
+	off := 12
+	if m.Name, off, err = readDNSName(b, off); err != nil {
+		return err
+	}
+	if off+4 > len(b) {
+		return &ProtocolError{Message: "dnsMessage", Err: ErrTruncated}
+	}
+	m.Type = binary.BigEndian.Uint16(b[off:])
+	off += 4
+
+	m.Answers, m.Authority = nil, nil
+	for i := 0; i < int(ancount)+int(nscount); i++ {
+		var rr dnsRecord
+		if rr, off, err = readDNSRecord(b, off); err != nil {
+			// A truncated message keeps the records read so far.
+			if m.Truncated {
+				return nil
+			}
+			return err
+		}
+		if i < int(ancount) {
+			m.Answers = append(m.Answers, rr)
+		} else {
+			m.Authority = append(m.Authority, rr)
+		}
+	}
+	return nil
+}
+
+// WriteBinary writes the message in a single call, without compressing
+// names. A query asks for recursion.
+func (m *dnsMessage) WriteBinary(w io.Writer) error {
+	var flags uint16
+	if m.Response {
+		flags |= 0x8000 | 0x0080 // QR, RA
+	}
+	if m.Truncated {
+		flags |= 0x0200
+	}
+	flags |= 0x0100 // RD
+	flags |= uint16(m.Rcode & 0x0F)
+
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b, m.ID)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(m.Authority)))
+
+	b, err := appendDNSName(b, m.Name)
+	if err != nil {
+		return fmt.Errorf("Cannot write dnsMessage, %s", err)
+	}
+	b = append(b, byte(m.Type>>8), byte(m.Type), 0, dnsClassIN)
+
+	for _, rr := range append(m.Answers[:len(m.Answers):len(m.Answers)], m.Authority...) {
+		if b, err = appendDNSName(b, rr.Name); err != nil {
+			return fmt.Errorf("Cannot write dnsMessage, %s", err)
+		}
+		data := rr.Data
+		if rr.Type == dnsTypeSOA {
+			// Root names for MNAME and RNAME, then the five counters.
+			data = make([]byte, 22)
+			binary.BigEndian.PutUint32(data[18:], rr.Minimum)
+		}
+		b = append(b, byte(rr.Type>>8), byte(rr.Type), byte(rr.Class>>8), byte(rr.Class))
+		b = append(b, byte(rr.TTL>>24), byte(rr.TTL>>16), byte(rr.TTL>>8), byte(rr.TTL))
+		b = append(b, byte(len(data)>>8), byte(len(data)))
+		b = append(b, data...)
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("Error writing dnsMessage: %v", err)
+	}
+	return nil
+}
+
+// readDNSName reads the name at off in message b, following compression
+// pointers, and returns it with the offset past it.
+func readDNSName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, &ProtocolError{Message: "dnsMessage", Err: ErrTruncated}
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(b) {
+				return "", 0, &ProtocolError{Message: "dnsMessage", Err: ErrTruncated}
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, &ProtocolError{Message: "dnsMessage", Err: fmt.Errorf("%w: compression loop", ErrMalformed)}
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+		case n&0xC0 != 0:
+			return "", 0, &ProtocolError{Message: "dnsMessage", Err: fmt.Errorf("%w: label type %#02x", ErrMalformed, n&0xC0)}
+		default:
+			if off+1+n > len(b) {
+				return "", 0, &ProtocolError{Message: "dnsMessage", Err: ErrTruncated}
+			}
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+func readDNSRecord(b []byte, off int) (dnsRecord, int, error) {
+	var rr dnsRecord
+	var err error
+	if rr.Name, off, err = readDNSName(b, off); err != nil {
+		return rr, 0, err
+	}
+	if off+10 > len(b) {
+		return rr, 0, &ProtocolError{Message: "dnsMessage", Err: ErrTruncated}
+	}
+	rr.Type = binary.BigEndian.Uint16(b[off:])
+	rr.Class = binary.BigEndian.Uint16(b[off+2:])
+	rr.TTL = binary.BigEndian.Uint32(b[off+4:])
+	n := int(binary.BigEndian.Uint16(b[off+8:]))
+	off += 10
+	if off+n > len(b) {
+		return rr, 0, &ProtocolError{Message: "dnsMessage", Err: ErrTruncated}
+	}
+
+	switch rr.Type {
+	case dnsTypeA, dnsTypeAAAA:
+		rr.Data = append([]byte(nil), b[off:off+n]...)
+	case dnsTypeSOA:
+		// MNAME and RNAME may be compressed, the counters follow them.
+		_, p, err := readDNSName(b, off)
+		if err == nil {
+			_, p, err = readDNSName(b, p)
+		}
+		if err != nil || p+20 > off+n {
+			return rr, 0, &ProtocolError{Message: "dnsMessage", Err: fmt.Errorf("%w: SOA record", ErrMalformed)}
+		}
+		rr.Minimum = binary.BigEndian.Uint32(b[p+16:])
+	}
+	return rr, off + n, nil
+}
+
+func appendDNSName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, fmt.Errorf("name too long: %d bytes", len(name))
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid name %q", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// dnsQueryID returns a random message ID, so that forged answers are hard
+// to match with a query.
+func dnsQueryID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// errDNSTruncated is returned for a UDP answer that did not fit, to retry
+// over TCP.
+var errDNSTruncated = errors.New("answer truncated")
+
+// dnsAnswer returns the addresses of the answer m to a query for name and
+// qtype, and how long they may be cached. A name not found is a
+// *net.DNSError with IsNotFound set, cacheable for the TTL the SOA record
+// of the zone gives, if there is one.
+func dnsAnswer(m *dnsMessage, name string, qtype uint16, server string) ([]net.IP, time.Duration, error) {
+	if !m.Response || !strings.EqualFold(m.Name, strings.TrimSuffix(name, ".")) || m.Type != qtype {
+		return nil, 0, &net.DNSError{Err: "answer does not match the question", Name: name, Server: server}
+	}
+	if m.Truncated {
+		return nil, 0, errDNSTruncated
+	}
+
+	switch m.Rcode {
+	case dnsRcodeSuccess, dnsRcodeNXDomain:
+	default:
+		return nil, 0, &net.DNSError{Err: fmt.Sprintf("server failure, rcode %d", m.Rcode), Name: name, Server: server, IsTemporary: true}
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for i, rr := range m.Answers {
+		if i == 0 || rr.TTL < ttl {
+			ttl = rr.TTL
+		}
+		if rr.Class != dnsClassIN || rr.Type != qtype {
+			continue
+		}
+		if (qtype == dnsTypeA && len(rr.Data) == net.IPv4len) || (qtype == dnsTypeAAAA && len(rr.Data) == net.IPv6len) {
+			ips = append(ips, net.IP(rr.Data))
+		}
+	}
+	if m.Rcode == dnsRcodeSuccess && len(ips) > 0 {
+		return ips, time.Duration(ttl) * time.Second, nil
+	}
+
+	// Negative answers are cached for the lesser of the TTL and the
+	// MINIMUM of the SOA record, RFC 2308.
+	negativeTTL := time.Duration(-1)
+	for _, rr := range m.Authority {
+		if rr.Type == dnsTypeSOA {
+			ttl = rr.TTL
+			if rr.Minimum < ttl {
+				ttl = rr.Minimum
+			}
+			negativeTTL = time.Duration(ttl) * time.Second
+		}
+	}
+	return nil, negativeTTL, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+}
+
+// dnsTypes returns the query types for the addresses of network, "ip",
+// "ip4" or "ip6".
+func dnsTypes(network string) []uint16 {
+	switch network {
+	case "ip4":
+		return []uint16{dnsTypeA}
+	case "ip6":
+		return []uint16{dnsTypeAAAA}
+	}
+	return []uint16{dnsTypeA, dnsTypeAAAA}
+}
+
+// lookupTypes queries the addresses of each type with query, concurrently,
+// and merges the answers. The name is only not found if it is not found
+// for any type.
+func lookupTypes(ctx context.Context, network, host string, query func(ctx context.Context, qtype uint16) ([]net.IP, time.Duration, error)) ([]net.IP, time.Duration, error) {
+	types := dnsTypes(network)
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	answers := make([]answer, len(types))
+	var wg sync.WaitGroup
+	for i, qtype := range types {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			a := &answers[i]
+			a.ips, a.ttl, a.err = query(ctx, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	var ttl, negativeTTL time.Duration
+	var err error
+	notFoundSeen := false
+	for _, a := range answers {
+		if len(a.ips) > 0 {
+			if ips == nil || a.ttl < ttl {
+				ttl = a.ttl
+			}
+			ips = append(ips, a.ips...)
+			continue
+		}
+		dnsErr, notFound := a.err.(*net.DNSError)
+		notFound = notFound && dnsErr.IsNotFound
+		if err == nil || !notFound {
+			err = a.err
+		}
+		if notFound && (!notFoundSeen || a.ttl < negativeTTL) {
+			negativeTTL = a.ttl
+			notFoundSeen = true
+		}
+	}
+	if len(ips) > 0 {
+		// The other type may fail, what was found is enough.
+		return ips, ttl, nil
+	}
+	return nil, negativeTTL, err
+}
+
+// DNSResolver looks up addresses with a DNS server, over UDP and over TCP
+// when an answer does not fit in a datagram.
+type DNSResolver struct {
+	// Addr is the host:port of the DNS server.
+	Addr string
+
+	// TCP queries over TCP only.
+	TCP bool
+
+	// Timeout limits each query, 5 seconds if zero.
+	Timeout time.Duration
+}
+
+func (r *DNSResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, _, err := r.lookupTTL(ctx, network, host)
+	return ips, err
+}
+
+func (r *DNSResolver) lookupTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	return lookupTypes(ctx, network, host, func(ctx context.Context, qtype uint16) ([]net.IP, time.Duration, error) {
+		if !r.TCP {
+			ips, ttl, err := r.query(ctx, "udp", host, qtype)
+			if err != errDNSTruncated {
+				return ips, ttl, err
+			}
+		}
+		return r.query(ctx, "tcp", host, qtype)
+	})
+}
+
+// query sends a single query over network.
+func (r *DNSResolver) query(ctx context.Context, network, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := new(net.Dialer).DialContext(ctx, network, r.Addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	q := &dnsMessage{ID: dnsQueryID(), Name: host, Type: qtype}
+	var b bytes.Buffer
+	if err := q.WriteBinary(&b); err != nil {
+		return nil, 0, err
+	}
+	msg := b.Bytes()
+	if network == "tcp" {
+		// Messages over TCP are prefixed with their length.
+		msg = append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, 0, err
+	}
+
+	m := new(dnsMessage)
+	for {
+		var packet []byte
+		if network == "tcp" {
+			var n [2]byte
+			if _, err := io.ReadFull(conn, n[:]); err != nil {
+				return nil, 0, err
+			}
+			packet = make([]byte, binary.BigEndian.Uint16(n[:]))
+			if _, err := io.ReadFull(conn, packet); err != nil {
+				return nil, 0, err
+			}
+		} else {
+			packet = make([]byte, 65535)
+			n, err := conn.Read(packet)
+			if err != nil {
+				return nil, 0, err
+			}
+			packet = packet[:n]
+		}
+
+		if err := m.ReadBinary(bytes.NewReader(packet)); err != nil {
+			return nil, 0, err
+		}
+		// Stray datagrams, such as late answers to an earlier query, are
+		// skipped.
+		if m.ID == q.ID {
+			return dnsAnswer(m, host, qtype, r.Addr)
+		}
+		if network == "tcp" {
+			return nil, 0, &net.DNSError{Err: "answer does not match the question", Name: host, Server: r.Addr}
+		}
+	}
+}
+
+// DoHResolver looks up addresses with a DNS over HTTPS server, RFC 8484.
+type DoHResolver struct {
+	// URL is the URL of the server, such as
+	// https://cloudflare-dns.com/dns-query.
+	URL string
+
+	// Client sends the queries, http.DefaultClient if nil.
+	Client *http.Client
+
+	// Timeout limits each query, 5 seconds if zero.
+	Timeout time.Duration
+}
+
+func (r *DoHResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, _, err := r.lookupTTL(ctx, network, host)
+	return ips, err
+}
+
+func (r *DoHResolver) lookupTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	return lookupTypes(ctx, network, host, func(ctx context.Context, qtype uint16) ([]net.IP, time.Duration, error) {
+		return r.query(ctx, host, qtype)
+	})
+}
+
+func (r *DoHResolver) query(ctx context.Context, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The ID is 0, for HTTP caches, RFC 8484 section 4.1.
+	q := &dnsMessage{Name: host, Type: qtype}
+	var b bytes.Buffer
+	if err := q.WriteBinary(&b); err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.URL, &b)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, &net.DNSError{Err: "HTTP " + resp.Status, Name: host, Server: r.URL, IsTemporary: true}
+	}
+
+	m := new(dnsMessage)
+	if err := m.ReadBinary(io.LimitReader(resp.Body, 65535)); err != nil {
+		return nil, 0, err
+	}
+	return dnsAnswer(m, host, qtype, r.URL)
+}
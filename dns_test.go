@@ -0,0 +1,298 @@
+package gator
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testZone answers the queries of the fake DNS servers:
+//
+//	a.test     A and AAAA records
+//	v4.test    an A record only
+//	big.test   an A record too large for UDP
+//	fail.test  a server failure
+//
+// Other names do not exist.
+func testZone(q *dnsMessage, network string) *dnsMessage {
+	m := &dnsMessage{ID: q.ID, Response: true, Name: q.Name, Type: q.Type}
+	name := strings.ToLower(q.Name)
+	soa := dnsRecord{Name: "test", Type: dnsTypeSOA, Class: dnsClassIN, TTL: 600, Minimum: 900}
+	a := func(ttl uint32, ip string) dnsRecord {
+		return dnsRecord{Name: q.Name, Type: dnsTypeA, Class: dnsClassIN, TTL: ttl, Data: net.ParseIP(ip).To4()}
+	}
+
+	switch {
+	case name == "a.test" && q.Type == dnsTypeA:
+		m.Answers = []dnsRecord{a(300, "192.0.2.1")}
+	case name == "a.test" && q.Type == dnsTypeAAAA:
+		m.Answers = []dnsRecord{{Name: q.Name, Type: dnsTypeAAAA, Class: dnsClassIN, TTL: 60, Data: net.ParseIP("2001:db8::1")}}
+	case name == "v4.test" && q.Type == dnsTypeA:
+		m.Answers = []dnsRecord{a(300, "192.0.2.2")}
+	case name == "v4.test":
+		soa.Minimum = 120
+		m.Authority = []dnsRecord{soa}
+	case name == "big.test" && network == "udp":
+		m.Truncated = true
+	case name == "big.test":
+		m.Answers = []dnsRecord{a(300, "192.0.2.3")}
+	case name == "fail.test":
+		m.Rcode = 2
+	default:
+		m.Rcode = dnsRcodeNXDomain
+		m.Authority = []dnsRecord{soa}
+	}
+	return m
+}
+
+// dnsServer is a fake DNS server answering from testZone over UDP and TCP
+// on the same port.
+type dnsServer struct {
+	addr string
+
+	mu      sync.Mutex
+	queries map[string]int // by network
+}
+
+func startDNS(t *testing.T) *dnsServer {
+	t.Helper()
+	s := &dnsServer{queries: make(map[string]int)}
+
+	var pc net.PacketConn
+	var ln net.Listener
+	for i := 0; ln == nil && i < 10; i++ {
+		var err error
+		if pc, err = net.ListenPacket("udp4", "127.0.0.1:0"); err != nil {
+			t.Skipf("udp loopback unavailable: %s", err)
+		}
+		if ln, err = net.Listen("tcp4", pc.LocalAddr().String()); err != nil {
+			pc.Close()
+		}
+	}
+	if ln == nil {
+		t.Skip("no port free over both UDP and TCP")
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		ln.Close()
+	})
+	s.addr = pc.LocalAddr().String()
+
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var out bytes.Buffer
+			if err := s.answer(b[:n], "udp").WriteBinary(&out); err == nil {
+				pc.WriteTo(out.Bytes(), addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var n [2]byte
+				if _, err := io.ReadFull(c, n[:]); err != nil {
+					return
+				}
+				b := make([]byte, binary.BigEndian.Uint16(n[:]))
+				if _, err := io.ReadFull(c, b); err != nil {
+					return
+				}
+				var out bytes.Buffer
+				if err := s.answer(b, "tcp").WriteBinary(&out); err == nil {
+					c.Write(append([]byte{byte(out.Len() >> 8), byte(out.Len())}, out.Bytes()...))
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *dnsServer) answer(b []byte, network string) *dnsMessage {
+	s.mu.Lock()
+	s.queries[network]++
+	s.mu.Unlock()
+
+	q := new(dnsMessage)
+	if err := q.ReadBinary(bytes.NewReader(b)); err != nil {
+		return &dnsMessage{Response: true, Rcode: 1}
+	}
+	return testZone(q, network)
+}
+
+func (s *dnsServer) count(network string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[network]
+}
+
+func TestDNSMessage(t *testing.T) {
+	// An answer to a.test A, with the name of the answer compressed.
+	data := []byte{
+		0x12, 0x34, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0,
+		1, 'a', 4, 't', 'e', 's', 't', 0, 0, 1, 0, 1,
+		0xC0, 12, 0, 1, 0, 1, 0, 0, 0x01, 0x2C, 0, 4, 192, 0, 2, 1,
+	}
+	m := new(dnsMessage)
+	if err := m.ReadBinary(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	want := &dnsMessage{
+		ID: 0x1234, Response: true, Name: "a.test", Type: dnsTypeA,
+		Answers: []dnsRecord{{Name: "a.test", Type: dnsTypeA, Class: dnsClassIN, TTL: 300, Data: []byte{192, 0, 2, 1}}},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("ReadBinary = %+v, want %+v", m, want)
+	}
+
+	want.Authority = []dnsRecord{{Name: "test", Type: dnsTypeSOA, Class: dnsClassIN, TTL: 600, Minimum: 900}}
+	got, err := roundTrip(want, func() codec { return new(dnsMessage) }, 0)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, %v, want %+v", got, err, want)
+	}
+
+	for _, data := range [][]byte{
+		data[:11],
+		data[:len(data)-1],
+		// A name pointing to itself.
+		{0, 0, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12, 0, 1, 0, 1},
+		// Two questions.
+		{0, 0, 0x81, 0x80, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 1, 0, 1},
+	} {
+		var pe *ProtocolError
+		if err := new(dnsMessage).ReadBinary(bytes.NewReader(data)); !errors.As(err, &pe) {
+			t.Errorf("ReadBinary(% x) = %v, want a *ProtocolError", data, err)
+		}
+	}
+
+	if err := (&dnsMessage{Name: "a..test"}).WriteBinary(io.Discard); err == nil {
+		t.Error("wrote an empty label")
+	}
+}
+
+func FuzzDNSMessage(f *testing.F) {
+	f.Add([]byte{0, 0, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var pe *ProtocolError
+		if err := new(dnsMessage).ReadBinary(bytes.NewReader(data)); err != nil && !errors.As(err, &pe) {
+			t.Fatalf("ReadBinary(% x) = %v, want a *ProtocolError", data, err)
+		}
+	})
+}
+
+// checkLookups runs the lookups of testZone with lookup.
+func checkLookups(t *testing.T, lookup func(ctx context.Context, network, host string) ([]net.IP, time.Duration, error)) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		network, host string
+		ips           []string
+		ttl           time.Duration
+	}{
+		{"ip", "a.test", []string{"192.0.2.1", "2001:db8::1"}, time.Minute},
+		{"ip4", "A.TEST.", []string{"192.0.2.1"}, 5 * time.Minute},
+		{"ip", "v4.test", []string{"192.0.2.2"}, 5 * time.Minute},
+		{"ip4", "big.test", []string{"192.0.2.3"}, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		ips, ttl, err := lookup(ctx, tt.network, tt.host)
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.ips) || ttl != tt.ttl {
+			t.Errorf("lookup(%s, %s) = %v, %v, %v, want %v, %v", tt.network, tt.host, got, ttl, err, tt.ips, tt.ttl)
+		}
+	}
+
+	// Names not found carry the TTL of their zone.
+	for _, tt := range []struct {
+		network, host string
+		ttl           time.Duration
+	}{
+		{"ip", "nx.test", 10 * time.Minute},
+		{"ip6", "v4.test", 2 * time.Minute},
+	} {
+		_, ttl, err := lookup(ctx, tt.network, tt.host)
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound || ttl != tt.ttl {
+			t.Errorf("lookup(%s, %s) = %v, %v, want not found for %v", tt.network, tt.host, ttl, err, tt.ttl)
+		}
+	}
+
+	_, _, err := lookup(ctx, "ip4", "fail.test")
+	if dnsErr, ok := err.(*net.DNSError); !ok || dnsErr.IsNotFound || !dnsErr.IsTemporary {
+		t.Errorf("lookup(fail.test) = %v, want a temporary failure", err)
+	}
+}
+
+func TestDNSResolver(t *testing.T) {
+	server := startDNS(t)
+
+	checkLookups(t, (&DNSResolver{Addr: server.addr}).lookupTTL)
+	if server.count("udp") == 0 || server.count("tcp") != 1 {
+		t.Errorf("queried %d times over UDP and %d over TCP, want TCP for big.test only", server.count("udp"), server.count("tcp"))
+	}
+
+	udp := server.count("udp")
+	checkLookups(t, (&DNSResolver{Addr: server.addr, TCP: true}).lookupTTL)
+	if server.count("udp") != udp {
+		t.Error("queried over UDP with TCP set")
+	}
+
+	// A server that does not answer.
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	_, err = (&DNSResolver{Addr: pc.LocalAddr().String(), Timeout: 50 * time.Millisecond}).LookupIP(context.Background(), "ip", "a.test")
+	if !isTimeout(err) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+}
+
+func TestDoHResolver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		q := new(dnsMessage)
+		if err := q.ReadBinary(r.Body); err != nil || q.ID != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		testZone(q, "https").WriteBinary(w)
+	}))
+	defer server.Close()
+
+	checkLookups(t, (&DoHResolver{URL: server.URL}).lookupTTL)
+
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+	if _, err := (&DoHResolver{URL: broken.URL}).LookupIP(context.Background(), "ip", "a.test"); err == nil {
+		t.Error("resolved with a server answering 404")
+	}
+}
@@ -0,0 +1,104 @@
+package gator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Errors of messages a client sent that could not be read, found in the Err
+// of a ProtocolError.
+var (
+	// ErrTruncated is returned when a message ends early.
+	ErrTruncated = errors.New("message truncated")
+
+	// ErrVersion is returned for a version number that is not supported.
+	ErrVersion = errors.New("unsupported version")
+
+	// ErrCommand is returned for a command that is not supported.
+	ErrCommand = errors.New("unsupported command")
+
+	// ErrAddressType is returned for a SOCKS5 ATYP that is not supported.
+	ErrAddressType = errors.New("unsupported address type")
+
+	// ErrMalformed is returned for a message that breaks the protocol in
+	// some other way.
+	ErrMalformed = errors.New("malformed message")
+
+	// ErrHandshakeTooLarge is returned when a client sends more than a
+	// stage of the handshake allows.
+	ErrHandshakeTooLarge = errors.New("handshake too large")
+)
+
+// ProtocolError reports a message from a client that could not be read.
+// Err wraps one of the errors above, or is the error of the connection,
+// such as a timeout.
+type ProtocolError struct {
+	// Message names the message, such as "Socks5Request".
+	Message string
+	Err     error
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// errAuthFailed is wrapped by the errors of authenticators that rejected a
+// client.
+var errAuthFailed = errors.New("authentication failed")
+
+// replyCode5 maps the error that failed a request to the REP field of a
+// SOCKS5 reply.
+func replyCode5(err error) byte {
+	var dnsErr *net.DNSError
+
+	switch {
+	case err == nil:
+		return 0x00 //Succeeded
+	case errors.Is(err, errNotAllowed):
+		return 0x02 //Connection not allowed by ruleset
+	case errors.Is(err, ErrCommand):
+		return 0x07 //Command not supported
+	case errors.Is(err, ErrAddressType):
+		return 0x08 //Address type not supported
+	case errors.Is(err, syscall.ENETUNREACH):
+		return 0x03 //Network unreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return 0x04 //Host unreachable
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return 0x04 //Host unreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return 0x05 //Connection refused
+	case isTimeout(err):
+		return 0x06 //TTL expired
+	}
+	return 0x01 //General SOCKS server failure
+}
+
+// replyCode4 maps the error that failed a request to the CD field of a
+// SOCKS4 reply. SOCKS4 has no codes for the reasons a connection fails, and
+// 92 is only meant for failures to reach identd, which is not used.
+func replyCode4(err error) byte {
+	switch {
+	case err == nil:
+		return 90 //Request granted
+	case errors.Is(err, errAuthFailed), errors.Is(err, errUserIDUnsupported):
+		return 93 //Different user-ids
+	}
+	return 91 //Request rejected or failed
+}
+
+// isTimeout reports whether err is a timeout, such as an expired connect
+// timeout.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,81 @@
+package gator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// dialError wraps errno the way net.Dial reports a failed connect.
+func dialError(errno syscall.Errno) error {
+	return &net.OpError{
+		Op:  "dial",
+		Net: "tcp",
+		Err: os.NewSyscallError("connect", errno),
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestReplyCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		v5   byte
+		v4   byte
+	}{
+		{"success", nil, 0x00, 90},
+		{"general", errors.New("boom"), 0x01, 91},
+		{"not allowed", errNotAllowed, 0x02, 91},
+		{"wrapped not allowed", fmt.Errorf("rules: %w", errNotAllowed), 0x02, 91},
+		{"unsupported command", &ProtocolError{Message: "Socks5Request", Err: fmt.Errorf("%w 9", ErrCommand)}, 0x07, 91},
+		{"unsupported address type", &ProtocolError{Message: "Socks5Request", Err: fmt.Errorf("%w 2", ErrAddressType)}, 0x08, 91},
+		{"network unreachable", dialError(syscall.ENETUNREACH), 0x03, 91},
+		{"host unreachable", dialError(syscall.EHOSTUNREACH), 0x04, 91},
+		{"host down", dialError(syscall.EHOSTDOWN), 0x04, 91},
+		{"nxdomain", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nx.invalid", IsNotFound: true}}, 0x04, 91},
+		{"dns server failure", &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, 0x01, 91},
+		{"connection refused", dialError(syscall.ECONNREFUSED), 0x05, 91},
+		{"connect timeout", &net.OpError{Op: "dial", Err: timeoutError{}}, 0x06, 91},
+		{"deadline exceeded", fmt.Errorf("Dial: %w", context.DeadlineExceeded), 0x06, 91},
+		{"cancelled", context.Canceled, 0x01, 91},
+		{"auth failed", fmt.Errorf("%w for user %q", errAuthFailed, "alice"), 0x01, 93},
+		{"userid unsupported", errUserIDUnsupported, 0x01, 93},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyCode5(tt.err); got != tt.v5 {
+				t.Errorf("replyCode5(%v) = %#02x, want %#02x", tt.err, got, tt.v5)
+			}
+			if got := replyCode4(tt.err); got != tt.v4 {
+				t.Errorf("replyCode4(%v) = %d, want %d", tt.err, got, tt.v4)
+			}
+		})
+	}
+}
+
+func TestReplyCodeRefusedDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = net.Dial("tcp", addr)
+	if err == nil {
+		t.Skip("dial to a closed port succeeded")
+	}
+	if got := replyCode5(err); got != 0x05 {
+		t.Errorf("replyCode5(%v) = %#02x, want 0x05", err, got)
+	}
+}
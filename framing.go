@@ -0,0 +1,77 @@
+package gator
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Limits on the bytes a client may send in each stage of a handshake. The
+// SOCKS limits are those of the largest valid message, without the version
+// byte ServeConn has already consumed where there is one.
+const (
+	maxMethodRequest = 1 + 255                           // NMETHODS METHODS
+	maxAuthRequest   = 1 + 1 + 255 + 1 + 255             // VER ULEN UNAME PLEN PASSWD
+	maxSocks5Request = 4 + 1 + 255 + 2                   // VER CMD RSV ATYP DST.ADDR DST.PORT
+	maxSocks4Request = 1 + 2 + 4 + 2*(maxStringLength+1) // CD DSTPORT DSTIP USERID domain
+	maxHTTPHeader    = 64 << 10
+)
+
+// handshakeReader reads the messages a client sends before its session is
+// set up. Each stage of the handshake may only take a limited number of
+// bytes and, with a timeout, a limited time.
+type handshakeReader struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	// remaining is the number of bytes left in the current stage, negative
+	// once the handshake is done.
+	remaining int
+}
+
+// stage starts the next stage of the handshake, allowing the client limit
+// more bytes.
+func (h *handshakeReader) stage(limit int) {
+	h.remaining = limit
+	if h.timeout > 0 {
+		h.conn.SetReadDeadline(time.Now().Add(h.timeout))
+	}
+}
+
+// done lifts the limits once the handshake is over.
+func (h *handshakeReader) done() {
+	h.remaining = -1
+	if h.timeout > 0 {
+		h.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (h *handshakeReader) Read(b []byte) (int, error) {
+	if h.remaining < 0 {
+		return h.conn.Read(b)
+	}
+	if h.remaining == 0 {
+		return 0, ErrHandshakeTooLarge
+	}
+	if len(b) > h.remaining {
+		b = b[:h.remaining]
+	}
+	n, err := h.conn.Read(b)
+	h.remaining -= n
+	return n, err
+}
+
+func (h *handshakeReader) Write(b []byte) (int, error) {
+	return h.conn.Write(b)
+}
+
+// readFull reads exactly len(b) bytes of message from r.
+func readFull(r io.Reader, b []byte, message string) error {
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrTruncated
+		}
+		return &ProtocolError{Message: message, Err: err}
+	}
+	return nil
+}
@@ -1,67 +1,75 @@
-package main
+// Package gator implements a small SOCKS4, SOCKS4A, SOCKS5 and HTTP proxy
+// server. All protocols are served on the same port.
+package gator
 
 import (
-	"flag"
-	"fmt"
-	"log"
+	"bufio"
+	"errors"
+	"io"
 	"net"
+	"os"
+	"sync"
+	"time"
 )
 
-func main() {
-	port := flag.Int("port", 10080, "port to listen for connections on")
-
-	flag.Parse()
-
-	address := fmt.Sprintf(":%d", *port)
-
-	ln, err := net.Listen("tcp", address)
-	if err != nil {
-		log.Printf("Failed to listen on \"%s\" - error: %s", address, err.Error())
-		return
-	}
-
-	log.Printf("Listening for new connections on %s", address)
-
-	for {
-		c, err := ln.Accept()
-		if err != nil {
-			log.Printf("Failed to accept connection: %s", err.Error())
-			continue
-		}
-		go handleConnection(c)
-	}
-}
-
+// SockProxy is a protocol handler, it serves a single client connection.
 type SockProxy interface {
 	Proxy(client net.Conn) error
 }
 
-func handleConnection(client net.Conn) {
-	defer client.Close()
+// bufferedConn is a net.Conn that reads through r, so that bytes already
+// buffered by r are not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
 
-	// sock version
-	ver := make([]byte, 1)
-	if n, _ := client.Read(ver); n != 1 {
-		log.Println("MethodRequest packet is too short")
-		return
+// watchHangup calls hangup if the client closes its connection while the
+// returned function has not been called yet. That function stops watching
+// and reports whether the client hung up. Data the client sends meanwhile
+// stays buffered for the relay.
+func watchHangup(client net.Conn, hangup func()) func() bool {
+	bc, ok := client.(*bufferedConn)
+	if !ok {
+		return func() bool { return false }
 	}
 
-	var proxy SockProxy
+	var hungUp bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := bc.r.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			hungUp = true
+			hangup()
+		}
+	}()
 
-	switch ver[0] {
-	case 0x04:
-		proxy = new(Sock4)
-	case 0x05:
-		proxy = new(Sock5)
-	default:
-		log.Println("invalid socks version:", ver)
-		return
+	return func() bool {
+		bc.SetReadDeadline(time.Now())
+		wg.Wait()
+		bc.SetReadDeadline(time.Time{})
+		return hungUp
 	}
+}
 
-	if err := proxy.Proxy(client); err != nil {
-		log.Println("Proxy error:", err)
-		return
-	}
+// relay copies data in both directions until either side stops.
+func relay(client, server net.Conn) {
+	//Buffered so that the other goroutine doesn't deadlock
+	stopChan := make(chan bool, 1)
+	go func() {
+		io.Copy(client, server)
+		stopChan <- true
+	}()
+	go func() {
+		io.Copy(server, client)
+		stopChan <- true
+	}()
 
-	return
+	//Wait for either of the copies to stop
+	<-stopChan
 }
@@ -0,0 +1,97 @@
+package gator
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Guard refuses connections to destinations in its deny set. It checks the
+// IP address that is actually connected to, after domain names have been
+// resolved, so that a public name that resolves to an internal address,
+// including one that changes between lookups, cannot reach it.
+type Guard struct {
+	// Deny are the networks that cannot be connected to.
+	Deny []*net.IPNet
+
+	// Allow are exceptions to Deny.
+	Allow []*net.IPNet
+}
+
+// DefaultDeny are the networks that are not on the public internet:
+// loopback, private and shared networks, link-local networks with their
+// cloud metadata services, multicast and reserved addresses.
+var DefaultDeny = mustParseNetworks(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // shared address space
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, 169.254.169.254 is cloud metadata
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, and broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local, fd00:ec2::254 is cloud metadata
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+// DefaultGuard denies DefaultDeny.
+var DefaultGuard = &Guard{Deny: DefaultDeny}
+
+// Check returns an error if ip may not be connected to.
+func (g *Guard) Check(ip net.IP) error {
+	if containsIP(g.Allow, ip) {
+		return nil
+	}
+	for _, n := range g.Deny {
+		if n.Contains(ip) {
+			return fmt.Errorf("%w: %s is in denied network %s", errNotAllowed, ip, n)
+		}
+	}
+	return nil
+}
+
+// Control checks the address of a connection about to be made. It has the
+// signature of net.Dialer.Control.
+func (g *Guard) Control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %s is not an IP address", errNotAllowed, host)
+	}
+	return g.Check(ip)
+}
+
+// ParseNetworks parses a comma separated list of CIDR networks and IP
+// addresses.
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		n, err := parseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+func mustParseNetworks(list ...string) []*net.IPNet {
+	networks, err := ParseNetworks(strings.Join(list, ","))
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
@@ -0,0 +1,105 @@
+package gator
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGuardCheck(t *testing.T) {
+	guard := &Guard{Deny: DefaultDeny, Allow: mustParseNetworks("10.1.0.0/16")}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"10.1.2.3", true},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"255.255.255.255", false},
+		{"::", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fd00:ec2::254", false},
+		{"fe80::1", false},
+		{"192.0.2.1", true},
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+	}
+
+	for _, tt := range tests {
+		err := guard.Check(net.ParseIP(tt.ip))
+		if (err == nil) != tt.allowed {
+			t.Errorf("Check(%s) = %v, want allowed %v", tt.ip, err, tt.allowed)
+		}
+		if err != nil && !errors.Is(err, errNotAllowed) {
+			t.Errorf("Check(%s) = %v, want errNotAllowed", tt.ip, err)
+		}
+	}
+
+	if err := new(Guard).Check(net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("empty Guard: %s", err)
+	}
+}
+
+// TestGuardResolvedAddress checks that the guard applies to the address a
+// domain name resolves to, not only to IP addresses in requests.
+func TestGuardResolvedAddress(t *testing.T) {
+	if _, err := net.LookupIP("localhost"); err != nil {
+		t.Skipf("cannot resolve localhost: %s", err)
+	}
+	echo := startEcho(t, "tcp4").(*net.TCPAddr)
+
+	proxy := serve(t, "tcp4", &Server{Authenticators: []Authenticator{NoAuth{}}, Logger: log.New(io.Discard, "", 0)})
+
+	dial := func(t *testing.T) net.Conn {
+		conn, err := net.DialTimeout("tcp", proxy.String(), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	t.Run("socks5", func(t *testing.T) {
+		conn := dial(t)
+		if err := (&Method5Request{Methods: []byte{0x00}}).WriteBinary(conn); err != nil {
+			t.Fatal(err)
+		}
+		if err := new(Method5Reply).ReadBinary(conn); err != nil {
+			t.Fatal(err)
+		}
+		req := &Socks5Request{Version: 0x05, Command: CmdConnect, AddressType: 0x03, Domain: "localhost", Port: uint16(echo.Port)}
+		if err := req.WriteBinary(conn); err != nil {
+			t.Fatal(err)
+		}
+		rep := new(Socks5Reply)
+		if err := rep.ReadBinary(conn); err != nil {
+			t.Fatal(err)
+		}
+		if rep.Reply != 0x02 {
+			t.Errorf("reply %#02x, want 0x02", rep.Reply)
+		}
+	})
+
+	t.Run("http", func(t *testing.T) {
+		conn := dial(t)
+		resp, err := httpConnect(conn, "localhost", echo.Port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("status %s, want 403", resp.Status)
+		}
+	})
+}
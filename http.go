@@ -0,0 +1,284 @@
+package gator
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HTTPProxy serves HTTP CONNECT tunnels and forwards plain HTTP requests
+// that carry an absolute URI, as sent to a proxy. The zero value serves
+// them as a zero Server would.
+type HTTPProxy struct {
+	server *Server
+
+	// identity is who the client authenticated as.
+	identity *Identity
+}
+
+// NewHTTPProxy returns an HTTP proxy handler with the settings of s.
+func NewHTTPProxy(s *Server) *HTTPProxy {
+	return &HTTPProxy{server: s}
+}
+
+// hopHeaders only apply to a single connection and are not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// isHTTP reports whether the first byte of a connection can start an HTTP
+// request line. Methods are upper case ASCII, SOCKS starts with a version
+// number.
+func isHTTP(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+func (h *HTTPProxy) Proxy(client net.Conn) error {
+	if h.server == nil {
+		h.server = new(Server)
+	}
+	// A handler used on its own, not by ServeConn, tracks the session
+	// itself, for keep-alive and Shutdown.
+	if !h.server.setIdle(client, false) {
+		if !h.server.trackConn(client, true) {
+			return ErrServerClosed
+		}
+		defer h.server.trackConn(client, false)
+	}
+
+	hs := &handshakeReader{conn: client, timeout: h.server.HandshakeTimeout}
+	br := bufio.NewReader(hs)
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return h.server.dialContext(ctx, client.RemoteAddr(), h.identity, network, address)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	for first := true; ; first = false {
+		// Between requests the connection is idle, Shutdown closes it
+		// without waiting.
+		if !first && !h.server.setIdle(client, true) {
+			return nil
+		}
+
+		hs.stage(maxHTTPHeader)
+		req, err := http.ReadRequest(br)
+		if err == io.EOF || (err != nil && h.server.shuttingDown()) {
+			return nil
+		}
+		if !first && isTimeout(err) {
+			return nil
+		}
+		if errors.Is(err, ErrHandshakeTooLarge) {
+			httpError(http.StatusRequestHeaderFieldsTooLarge, err).Write(client)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		hs.done()
+		h.server.setIdle(client, false)
+
+		if err := h.authenticate(req); err != nil {
+			resp := httpError(http.StatusProxyAuthRequired, err)
+			resp.Header.Set("Proxy-Authenticate", `Basic realm="gator"`)
+			resp.Write(client)
+			return err
+		}
+
+		h.server.logf("http %s %s, user: %s\n", req.Method, req.Host, h.identity)
+
+		if err := h.allow(client, req); err != nil {
+			httpError(http.StatusForbidden, err).Write(client)
+			return err
+		}
+
+		if req.Method == "CONNECT" {
+			return h.connect(&bufferedConn{Conn: client, r: br}, req)
+		}
+
+		if !req.URL.IsAbs() {
+			err := errors.New("request URI is not absolute")
+			httpError(http.StatusBadRequest, err).Write(client)
+			return err
+		}
+
+		if err := h.forward(client, transport, req); err != nil {
+			return err
+		}
+		if req.Close {
+			return nil
+		}
+	}
+}
+
+// authenticate checks the Proxy-Authorization header. A client that sends
+// credentials is treated like a SOCKS5 client that offers username/password
+// besides no authentication, so the server's preference decides.
+func (h *HTTPProxy) authenticate(req *http.Request) error {
+	username, password, hasBasic := proxyBasicAuth(req)
+
+	methods := []byte{0x00}
+	if hasBasic {
+		methods = append(methods, 0x02)
+	}
+
+	auth := selectMethod(h.server.Authenticators, methods)
+	if auth == nil {
+		return errors.New("Proxy authentication required")
+	}
+
+	identity, err := auth.Password(username, password)
+	if err != nil {
+		return err
+	}
+	h.identity = identity
+	return nil
+}
+
+// allow consults the server's rules. Requests without a port in their host
+// go to the default port of their scheme.
+func (h *HTTPProxy) allow(client net.Conn, req *http.Request) error {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(req.Host, "["), "]"), "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("Invalid port: %s", port)
+	}
+
+	r := &Request{
+		Command:  CmdConnect,
+		Source:   client.RemoteAddr(),
+		Host:     host,
+		Port:     p,
+		Identity: h.identity,
+	}
+	if !h.server.allow(r) {
+		return errNotAllowed
+	}
+	return nil
+}
+
+// connect opens a tunnel to the host:port of a CONNECT request.
+func (h *HTTPProxy) connect(client net.Conn, req *http.Request) error {
+	server, err := h.server.dial(client, h.identity, "tcp", req.Host)
+	if err == errHungUp {
+		return err
+	}
+	if err != nil {
+		httpError(dialStatus(err), err).Write(client)
+		return fmt.Errorf("Dial: %s", err.Error())
+	}
+	defer server.Close()
+
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return fmt.Errorf("respond: %s", err)
+	}
+
+	relay(client, server)
+	return nil
+}
+
+// forward sends a plain HTTP request on to its origin server and writes the
+// response back to the client.
+func (h *HTTPProxy) forward(client net.Conn, transport http.RoundTripper, req *http.Request) error {
+	removeHopHeaders(req.Header)
+	req.RequestURI = ""
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		httpError(dialStatus(err), err).Write(client)
+		return fmt.Errorf("RoundTrip: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	if err := resp.Write(client); err != nil {
+		return fmt.Errorf("respond: %s", err)
+	}
+	return nil
+}
+
+// dialStatus is the status reported to the client when the connection to
+// the origin server failed with err.
+func dialStatus(err error) int {
+	if errors.Is(err, errNotAllowed) {
+		return http.StatusForbidden
+	}
+	if isTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// proxyBasicAuth returns the credentials of a Basic Proxy-Authorization
+// header.
+func proxyBasicAuth(req *http.Request) (username, password string, ok bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	i := strings.IndexByte(string(decoded), ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return string(decoded[:i]), string(decoded[i+1:]), true
+}
+
+// removeHopHeaders deletes the hop-by-hop headers, including any listed in
+// the Connection header.
+func removeHopHeaders(header http.Header) {
+	for _, field := range strings.Split(header.Get("Connection"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			header.Del(field)
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// httpError builds a response that reports err to the client and closes
+// the connection.
+func httpError(code int, err error) *http.Response {
+	body := fmt.Sprintf("%d %s: %s\n", code, http.StatusText(code), err)
+	return &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+}
@@ -0,0 +1,70 @@
+package gator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHTTPForward sends plain HTTP requests with absolute URIs over a kept
+// alive connection and checks what the origin server and the client see.
+func TestHTTPForward(t *testing.T) {
+	seen := make(chan *http.Request, 10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r
+		w.Header().Set("Connection", "X-Origin-Hop")
+		w.Header().Set("X-Origin-Hop", "1")
+		w.Header().Set("X-Origin", "1")
+		fmt.Fprintf(w, "path %s", r.URL.Path)
+	}))
+	defer origin.Close()
+
+	proxy := serve(t, "tcp4", &Server{Authenticators: []Authenticator{NoAuth{}}, Guard: allowLoopback, Logger: log.New(io.Discard, "", 0)})
+	conn := dialProxy(t, proxy)
+	br := bufio.NewReader(conn)
+
+	for _, path := range []string{"/one", "/two"} {
+		fmt.Fprintf(conn, "GET %s%s HTTP/1.1\r\nHost: %s\r\n"+
+			"Proxy-Connection: keep-alive\r\nProxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n"+
+			"Connection: X-Client-Hop\r\nX-Client-Hop: 1\r\nX-Client: 1\r\n\r\n",
+			origin.URL, path, origin.Listener.Addr())
+
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || string(body) != "path "+path {
+			t.Fatalf("%s: %s %q, %v", path, resp.Status, body, err)
+		}
+		if resp.Header.Get("X-Origin") == "" || resp.Header.Get("X-Origin-Hop") != "" {
+			t.Errorf("%s: response header %v, want X-Origin only", path, resp.Header)
+		}
+
+		r := <-seen
+		if r.Header.Get("X-Client") == "" {
+			t.Errorf("%s: X-Client not forwarded", path)
+		}
+		for _, name := range []string{"X-Client-Hop", "Proxy-Connection", "Proxy-Authorization"} {
+			if r.Header.Get(name) != "" {
+				t.Errorf("%s: %s forwarded", path, name)
+			}
+		}
+	}
+
+	// A request URI that is not absolute is refused.
+	fmt.Fprintf(conn, "GET /three HTTP/1.1\r\nHost: %s\r\n\r\n", origin.Listener.Addr())
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("relative request URI: %s, want 400", resp.Status)
+	}
+}
@@ -0,0 +1,326 @@
+package gator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pool is a Dialer that spreads connections over several upstreams. When an
+// upstream cannot be reached, the connection is retried on the next one and
+// the upstream is marked down until a health probe finds it up again.
+// Upstreams that refuse a destination, with an UpstreamError, are not
+// failed over, the others would likely refuse it too.
+type Pool struct {
+	// Upstreams are the dialers of the upstreams, such as those of
+	// ParseUpstream.
+	Upstreams []Dialer
+
+	// Balance picks the upstream for each connection.
+	Balance Balance
+
+	// Interval is the time between health probes, see Monitor. Without
+	// probes, an upstream that is down is retried after Interval, or after
+	// 30 seconds if zero.
+	Interval time.Duration
+
+	// Timeout limits each probe, 5 seconds if zero.
+	Timeout time.Duration
+
+	// Canary is the host:port that probes connect to through each upstream.
+	// If empty, probes only open a TCP connection to the upstream itself.
+	Canary string
+
+	// Egress is where the probes leave the host from, which should be where
+	// the connections through the pool leave from, see Server.Egress.
+	Egress Egress
+
+	// Logger receives upstreams going down and up, the standard logger if
+	// nil.
+	Logger *log.Logger
+
+	mu    sync.Mutex
+	state []upstreamState
+	next  int
+}
+
+// Balance is how a Pool picks upstreams.
+type Balance int
+
+// Balances of a Pool.
+const (
+	// RoundRobin takes the upstreams in turn.
+	RoundRobin Balance = iota
+
+	// LeastConnections takes the upstream with the fewest open connections.
+	LeastConnections
+
+	// HashDestination always takes the same upstream for a destination
+	// host, as long as it is up.
+	HashDestination
+)
+
+var balanceNames = []string{"round-robin", "least-connections", "hash"}
+
+func (b Balance) String() string {
+	if int(b) < len(balanceNames) {
+		return balanceNames[b]
+	}
+	return fmt.Sprintf("Balance(%d)", int(b))
+}
+
+// ParseBalance parses round-robin, least-connections or hash.
+func ParseBalance(s string) (Balance, error) {
+	for i, name := range balanceNames {
+		if s == name {
+			return Balance(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown balance %q", s)
+}
+
+type upstreamState struct {
+	down      bool
+	downSince time.Time
+	conns     int
+}
+
+// errNoProbe is returned by probe for an upstream that is not one of the
+// upstream dialers and has no Canary to probe it with.
+var errNoProbe = errors.New("nothing to probe")
+
+func (p *Pool) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(p.Upstreams) == 0 {
+		return nil, errors.New("pool has no upstreams")
+	}
+
+	var err error
+	for _, i := range p.order(address) {
+		var conn net.Conn
+		conn, err = p.Upstreams[i].DialContext(ctx, network, address)
+		if err == nil {
+			return p.track(i, conn), nil
+		}
+
+		var upErr *UpstreamError
+		if errors.As(err, &upErr) || ctx.Err() != nil {
+			return nil, err
+		}
+		p.setDown(i, true, err)
+	}
+	return nil, err
+}
+
+// order returns the indexes of the upstreams in the order to try them for
+// address: the one Balance picks and the others after it, those that are
+// down last.
+func (p *Pool) order(address string) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+
+	n := len(p.Upstreams)
+	first := 0
+	switch p.Balance {
+	case RoundRobin:
+		first = p.next % n
+		p.next++
+	case LeastConnections:
+		for i := range p.state {
+			if !p.isDown(i) && (p.isDown(first) || p.state[i].conns < p.state[first].conns) {
+				first = i
+			}
+		}
+	case HashDestination:
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		h := fnv.New32a()
+		h.Write([]byte(strings.ToLower(host)))
+		first = int(h.Sum32() % uint32(n))
+	}
+
+	var up, down []int
+	for k := 0; k < n; k++ {
+		i := (first + k) % n
+		if p.isDown(i) {
+			down = append(down, i)
+		} else {
+			up = append(up, i)
+		}
+	}
+	return append(up, down...)
+}
+
+// isDown reports whether upstream i is down and not due for a retry.
+func (p *Pool) isDown(i int) bool {
+	s := &p.state[i]
+	if !s.down {
+		return false
+	}
+	retry := p.Interval
+	if retry == 0 {
+		retry = 30 * time.Second
+	}
+	return time.Since(s.downSince) < retry
+}
+
+func (p *Pool) init() {
+	if len(p.state) != len(p.Upstreams) {
+		p.state = make([]upstreamState, len(p.Upstreams))
+	}
+}
+
+func (p *Pool) setDown(i int, down bool, err error) {
+	p.mu.Lock()
+	p.init()
+	s := &p.state[i]
+	changed := s.down != down
+	s.down = down
+	if down {
+		s.downSince = time.Now()
+	}
+	p.mu.Unlock()
+
+	if changed && down {
+		p.logf("upstream %s is down: %s", p.name(i), err)
+	} else if changed {
+		p.logf("upstream %s is up", p.name(i))
+	}
+}
+
+// track counts conn as open on upstream i until it is closed.
+func (p *Pool) track(i int, conn net.Conn) net.Conn {
+	p.mu.Lock()
+	p.init()
+	p.state[i].conns++
+	p.mu.Unlock()
+
+	return &poolConn{Conn: conn, release: func() {
+		p.mu.Lock()
+		p.state[i].conns--
+		p.mu.Unlock()
+	}}
+}
+
+type poolConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// Monitor probes every upstream each Interval until ctx is done, marking
+// them up or down. It returns at once if Interval is zero.
+func (p *Pool) Monitor(ctx context.Context) {
+	if p.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for i := range p.Upstreams {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := p.probe(ctx, i)
+				if err == errNoProbe || stopped(ctx) {
+					return
+				}
+				p.setDown(i, err != nil, err)
+			}(i)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopped reports whether ctx is done, or about to be: the probes may time
+// out on its deadline before it is.
+func stopped(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ctx.Err() != nil || ok && !time.Now().Before(deadline)
+}
+
+// probe connects to the Canary through upstream i, or to the upstream
+// itself without a Canary.
+func (p *Pool) probe(ctx context.Context, i int) error {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(withEgress(ctx, p.Egress), timeout)
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+	if p.Canary != "" {
+		conn, err = p.Upstreams[i].DialContext(ctx, "tcp", p.Canary)
+	} else if u, ok := p.Upstreams[i].(upstream); ok {
+		conn, err = p.Egress.dialer("tcp", nil).DialContext(ctx, "tcp", u.address())
+	} else {
+		return errNoProbe
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// name returns the name of upstream i for the log.
+func (p *Pool) name(i int) string {
+	if s, ok := p.Upstreams[i].(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+func (p *Pool) logf(format string, v ...interface{}) {
+	if p.Logger != nil {
+		p.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// ParseUpstreams returns the dialer of a comma separated list of upstream
+// URLs, in the format of ParseUpstream: the dialer of the upstream if there
+// is only one, a Pool with balance otherwise.
+func ParseUpstreams(list string, balance Balance) (Dialer, error) {
+	var dialers []Dialer
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		d, err := ParseUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		dialers = append(dialers, d)
+	}
+
+	switch len(dialers) {
+	case 0:
+		return nil, errors.New("no upstreams")
+	case 1:
+		return dialers[0], nil
+	}
+	return &Pool{Upstreams: dialers, Balance: balance}, nil
+}
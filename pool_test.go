@@ -0,0 +1,303 @@
+package gator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeUpstream is a pool member that counts its connections, or fails with
+// err if set.
+type fakeUpstream struct {
+	mu     sync.Mutex
+	name   string
+	err    error
+	dialed []string
+}
+
+func (d *fakeUpstream) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dialed = append(d.dialed, address)
+	if d.err != nil {
+		return nil, d.err
+	}
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func (d *fakeUpstream) String() string { return d.name }
+
+func (d *fakeUpstream) setErr(err error) {
+	d.mu.Lock()
+	d.err = err
+	d.mu.Unlock()
+}
+
+func (d *fakeUpstream) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.dialed)
+	d.dialed = nil
+	return n
+}
+
+func newPool(balance Balance, n int) (*Pool, []*fakeUpstream, *bytes.Buffer) {
+	logged := new(bytes.Buffer)
+	p := &Pool{Balance: balance, Logger: log.New(logged, "", 0)}
+	var upstreams []*fakeUpstream
+	for i := 0; i < n; i++ {
+		u := &fakeUpstream{name: string(rune('a' + i))}
+		upstreams = append(upstreams, u)
+		p.Upstreams = append(p.Upstreams, u)
+	}
+	return p, upstreams, logged
+}
+
+func TestPoolBalance(t *testing.T) {
+	ctx := context.Background()
+
+	p, upstreams, _ := newPool(RoundRobin, 3)
+	for i := 0; i < 6; i++ {
+		conn, err := p.DialContext(ctx, "tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	for _, u := range upstreams {
+		if n := u.count(); n != 2 {
+			t.Errorf("round-robin: %s dialed %d times, want 2", u.name, n)
+		}
+	}
+
+	// Connections left open steer new ones to the other upstreams.
+	p, upstreams, _ = newPool(LeastConnections, 2)
+	first, err := p.DialContext(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := p.DialContext(ctx, "tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if a, b := upstreams[0].count(), upstreams[1].count(); a != 1 || b != 2 {
+		t.Errorf("least-connections: dialed %d and %d times, want 1 and 2", a, b)
+	}
+	first.Close()
+	first.Close()
+	p.mu.Lock()
+	if p.state[0].conns != 0 {
+		t.Errorf("least-connections: %d connections open after closing", p.state[0].conns)
+	}
+	p.mu.Unlock()
+
+	// A host keeps its upstream, whatever the port or case.
+	p, upstreams, _ = newPool(HashDestination, 4)
+	for _, address := range []string{"example.com:80", "EXAMPLE.com:443", "example.com:8080"} {
+		conn, err := p.DialContext(ctx, "tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	var counts []int
+	for _, u := range upstreams {
+		counts = append(counts, u.count())
+	}
+	if !oneOf(counts, 3) {
+		t.Errorf("hash: dialed %v times, want one upstream for all", counts)
+	}
+}
+
+// oneOf reports whether counts is n for a single upstream and 0 for the
+// others.
+func oneOf(counts []int, n int) bool {
+	found := false
+	for _, c := range counts {
+		switch {
+		case c == n && !found:
+			found = true
+		case c != 0:
+			return false
+		}
+	}
+	return found
+}
+
+func TestPoolFailover(t *testing.T) {
+	ctx := context.Background()
+	p, upstreams, logged := newPool(RoundRobin, 2)
+	upstreams[0].setErr(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED})
+
+	for i := 0; i < 3; i++ {
+		conn, err := p.DialContext(ctx, "tcp", "example.com:80")
+		if err != nil {
+			t.Fatalf("dial %d: %s", i, err)
+		}
+		conn.Close()
+	}
+	// The upstream that is down is tried once, then left alone.
+	if a, b := upstreams[0].count(), upstreams[1].count(); a != 1 || b != 3 {
+		t.Errorf("dialed %d and %d times, want 1 and 3", a, b)
+	}
+	if want := "upstream a is down: dial tcp: connection refused\n"; logged.String() != want {
+		t.Errorf("logged %q, want %q", logged.String(), want)
+	}
+
+	// With every upstream down, those that are down are tried anyway.
+	upstreams[1].setErr(errors.New("unreachable"))
+	if _, err := p.DialContext(ctx, "tcp", "example.com:80"); err == nil {
+		t.Fatal("dialed through upstreams that are down")
+	}
+	upstreams[0].setErr(nil)
+	conn, err := p.DialContext(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// An upstream refusing the destination is not failed over.
+	p, upstreams, logged = newPool(RoundRobin, 2)
+	refused := &UpstreamError{Addr: "a", Reply: "SOCKS5 reply 2", Err: errNotAllowed}
+	upstreams[0].setErr(refused)
+	if _, err := p.DialContext(ctx, "tcp", "example.com:25"); !errors.Is(err, errNotAllowed) {
+		t.Errorf("got %v, want %v", err, refused)
+	}
+	if n := upstreams[1].count(); n != 0 || logged.Len() != 0 {
+		t.Errorf("failed over %d times and logged %q after a refusal", n, logged.String())
+	}
+}
+
+func TestPoolMonitor(t *testing.T) {
+	up, _ := startUpstream(t, NoAuth{})
+	ln := listenLoopback(t, "tcp4")
+	down := ln.Addr().String()
+	ln.Close()
+
+	logged := new(bytes.Buffer)
+	var mu sync.Mutex
+	p := &Pool{
+		Upstreams: []Dialer{&SOCKS5Dialer{Addr: up.String()}, &SOCKS5Dialer{Addr: down}},
+		Interval:  10 * time.Millisecond,
+		Logger:    log.New(&lockedWriter{w: logged, mu: &mu}, "", 0),
+	}
+	for _, canary := range []string{"", "example.com:80"} {
+		p.Canary = canary
+		p.state = nil
+		logged.Reset()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			p.Monitor(ctx)
+			close(done)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		<-done
+
+		p.mu.Lock()
+		if !p.state[1].down || p.state[0].down {
+			t.Errorf("canary %q: states %+v, want the second upstream down", canary, p.state)
+		}
+		p.mu.Unlock()
+		mu.Lock()
+		if want := "upstream socks5://" + down + " is down: "; !strings.HasPrefix(logged.String(), want) || strings.Count(logged.String(), "\n") != 1 {
+			t.Errorf("canary %q: logged %q, want %q once", canary, logged.String(), want)
+		}
+		mu.Unlock()
+	}
+
+	// Probes bring an upstream back up.
+	p.Upstreams[1] = &SOCKS5Dialer{Addr: up.String()}
+	p.Canary = ""
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	p.Monitor(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[1].down {
+		t.Errorf("upstream still down after a successful probe: %+v %q", p.state, logged.String())
+	}
+}
+
+type lockedWriter struct {
+	w  *bytes.Buffer
+	mu *sync.Mutex
+}
+
+func (w *lockedWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(b)
+}
+
+func TestParseUpstreams(t *testing.T) {
+	d, err := ParseUpstreams("socks5://a:1080", LeastConnections)
+	if _, ok := d.(*SOCKS5Dialer); !ok || err != nil {
+		t.Errorf("one upstream = %+v, %v", d, err)
+	}
+
+	d, err = ParseUpstreams("socks5://a:1080, http://b:3128", LeastConnections)
+	p, ok := d.(*Pool)
+	if !ok || err != nil || p.Balance != LeastConnections ||
+		!reflect.DeepEqual(p.Upstreams, []Dialer{&SOCKS5Dialer{Addr: "a:1080"}, &HTTPDialer{Addr: "b:3128"}}) {
+		t.Errorf("two upstreams = %+v, %v", d, err)
+	}
+
+	for _, list := range []string{"", ",", "socks5://a:1080,ftp://b:21"} {
+		if _, err := ParseUpstreams(list, RoundRobin); err == nil {
+			t.Errorf("ParseUpstreams(%q) succeeded", list)
+		}
+	}
+
+	if b, err := ParseBalance("hash"); b != HashDestination || err != nil {
+		t.Errorf("ParseBalance(hash) = %v, %v", b, err)
+	}
+	if _, err := ParseBalance("random"); err == nil {
+		t.Error("ParseBalance(random) succeeded")
+	}
+}
+
+func TestRouterPool(t *testing.T) {
+	route := mustParseRoute(t, "to .corp.example via socks5://alice:secret@a:1080,http://b:3128 balance hash")
+	p, ok := route.Dialer.(*Pool)
+	if !ok || p.Balance != HashDestination || len(p.Upstreams) != 2 {
+		t.Fatalf("dialer = %+v", route.Dialer)
+	}
+	if name := route.name(); name != "socks5://alice:xxxxx@a:1080,http://b:3128" {
+		t.Errorf("name = %q", name)
+	}
+	if _, err := ParseRoute("via socks5://a:1080 balance random"); err == nil {
+		t.Error("unknown balance accepted")
+	}
+}
+
+func TestPoolProbeEgress(t *testing.T) {
+	addr, sources := listenSources(t)
+	p := &Pool{
+		Upstreams: []Dialer{&SOCKS5Dialer{Addr: addr}},
+		Timeout:   time.Second,
+		Egress:    loopbackAlias(t, "127.0.0.2"),
+	}
+	for _, canary := range []string{"", "example.com:80"} {
+		p.Canary = canary
+		p.probe(context.Background(), 0)
+		if got := <-sources; got != "127.0.0.2" {
+			t.Errorf("canary %q: probed from %s, want 127.0.0.2", canary, got)
+		}
+	}
+}
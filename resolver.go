@@ -0,0 +1,311 @@
+package gator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver looks up the addresses of domain names. Network is "ip", "ip4"
+// or "ip6". *net.Resolver implements it, net.DefaultResolver is the system
+// resolver.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// ttlResolver is implemented by the resolvers that know how long their
+// answers may be cached. A negative TTL is unknown.
+type ttlResolver interface {
+	lookupTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error)
+}
+
+// Cache is a Resolver that keeps the answers of another one for as long as
+// their TTL allows, and names that were not found for as long as their zone
+// allows. Concurrent lookups of a name share a single query.
+type Cache struct {
+	// Resolver answers the names that are not cached, the system resolver
+	// if nil.
+	Resolver Resolver
+
+	// TTL is how long answers are kept when Resolver does not tell, as the
+	// system resolver does not, one minute if zero.
+	TTL time.Duration
+
+	// MaxTTL caps the TTL of every answer, one hour if zero.
+	MaxTTL time.Duration
+
+	// NegativeTTL is how long names that were not found are kept when
+	// Resolver does not tell, 30 seconds if zero. Other failures, such as
+	// timeouts, are not kept.
+	NegativeTTL time.Duration
+
+	// Size is the number of names kept at most, 4096 if zero.
+	Size int
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	// ready is closed once the lookup is done.
+	ready   chan struct{}
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+func (c *Cache) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	key := network + " " + strings.ToLower(strings.TrimSuffix(host, "."))
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+	}
+	e, ok := c.entries[key]
+	if ok {
+		select {
+		case <-e.ready:
+			if time.Now().After(e.expires) {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		e = &cacheEntry{ready: make(chan struct{})}
+		c.evict()
+		c.entries[key] = e
+		c.mu.Unlock()
+
+		// The lookup is not cancelled with ctx, others may be waiting
+		// for it.
+		go c.lookup(key, network, host, e)
+		c.mu.Lock()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-e.ready:
+		return e.ips, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lookup resolves host into e, and removes e right away if the answer is
+// not to be kept.
+func (c *Cache) lookup(key, network, host string, e *cacheEntry) {
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	ttl := time.Duration(-1)
+	if r, ok := resolver.(ttlResolver); ok {
+		e.ips, ttl, e.err = r.lookupTTL(ctx, network, host)
+	} else {
+		e.ips, e.err = resolver.LookupIP(ctx, network, host)
+	}
+
+	dnsErr, notFound := e.err.(*net.DNSError)
+	switch {
+	case e.err != nil && !(notFound && dnsErr.IsNotFound):
+		ttl = 0
+	case ttl >= 0:
+	case e.err == nil:
+		if ttl = c.TTL; ttl == 0 {
+			ttl = time.Minute
+		}
+	default:
+		if ttl = c.NegativeTTL; ttl == 0 {
+			ttl = 30 * time.Second
+		}
+	}
+	maxTTL := c.MaxTTL
+	if maxTTL == 0 {
+		maxTTL = time.Hour
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	c.mu.Lock()
+	e.expires = time.Now().Add(ttl)
+	if ttl <= 0 && c.entries[key] == e {
+		delete(c.entries, key)
+	}
+	close(e.ready)
+	c.mu.Unlock()
+}
+
+// evict makes room for one more entry, dropping the expired ones first.
+func (c *Cache) evict() {
+	size := c.Size
+	if size == 0 {
+		size = 4096
+	}
+	if len(c.entries) < size {
+		return
+	}
+
+	now := time.Now()
+	for key, e := range c.entries {
+		select {
+		case <-e.ready:
+			if now.After(e.expires) {
+				delete(c.entries, key)
+			}
+		default:
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < size {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// HostsResolver answers from a static table of names, such as a hosts file,
+// and passes the other names to Fallback.
+type HostsResolver struct {
+	// Hosts maps lower case names to their addresses.
+	Hosts map[string][]net.IP
+
+	// Fallback resolves the names not in Hosts. If nil, they are not found.
+	Fallback Resolver
+}
+
+func (r *HostsResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, _, err := r.lookupTTL(ctx, network, host)
+	return ips, err
+}
+
+func (r *HostsResolver) lookupTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	all, ok := r.Hosts[strings.ToLower(strings.TrimSuffix(host, "."))]
+	if !ok {
+		switch fallback := r.Fallback.(type) {
+		case nil:
+		case ttlResolver:
+			return fallback.lookupTTL(ctx, network, host)
+		default:
+			ips, err := fallback.LookupIP(ctx, network, host)
+			return ips, -1, err
+		}
+	}
+
+	var ips []net.IP
+	for _, ip := range all {
+		if network == "ip" || (network == "ip4") == (ip.To4() != nil) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, -1, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	// The table does not change, the answers can be kept for as long as
+	// the Cache allows.
+	return ips, 24 * time.Hour, nil
+}
+
+// LoadHosts reads a hosts file, with lines of an IP address followed by the
+// names that have that address:
+//
+//	10.1.2.3   db.internal.example db
+//	2001:db8::1 db.internal.example
+//
+// Blank lines and anything following a # are ignored.
+func LoadHosts(path string) (*HostsResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &HostsResolver{Hosts: make(map[string][]net.IP)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Zones of link-local addresses, as in fe80::1%lo0, are dropped.
+		ip := net.ParseIP(strings.SplitN(fields[0], "%", 2)[0])
+		if ip == nil {
+			return nil, fmt.Errorf("%s:%d: invalid address %q", path, n, fields[0])
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("%s:%d: no names for %s", path, n, ip)
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			r.Hosts[name] = append(r.Hosts[name], ip)
+		}
+	}
+	return r, scanner.Err()
+}
+
+// ParseResolver returns the resolver named by s:
+//
+//	system                               the system resolver
+//	udp://8.8.8.8:53, 8.8.8.8            a DNS server, over UDP then TCP
+//	tcp://8.8.8.8:53                     a DNS server, over TCP only
+//	https://dns.google/dns-query         a DNS over HTTPS server
+//
+// The port of a DNS server is 53 if omitted.
+func ParseResolver(s string) (Resolver, error) {
+	if s == "system" {
+		return net.DefaultResolver, nil
+	}
+	if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+		s = "udp://" + net.JoinHostPort(ip.String(), "53")
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("resolver %q: no host", s)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("resolver %q: unexpected path or query", s)
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "53")
+		}
+		return &DNSResolver{Addr: addr, TCP: u.Scheme == "tcp"}, nil
+	case "https":
+		return &DoHResolver{URL: s}, nil
+	}
+	return nil, fmt.Errorf("resolver %q: unknown scheme %q", s, u.Scheme)
+}
+
+// lookupIP resolves host with r, the system resolver if nil. An empty
+// answer is reported as a name not found.
+func lookupIP(ctx context.Context, r Resolver, network, host string) ([]net.IP, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ips, err := r.LookupIP(ctx, network, host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, err
+}
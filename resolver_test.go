@@ -0,0 +1,315 @@
+package gator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingResolver answers every name with ips, or err, and counts the
+// lookups. If block is set, lookups wait for it to be closed.
+type countingResolver struct {
+	ips   []net.IP
+	err   error
+	block chan struct{}
+
+	mu      sync.Mutex
+	lookups int
+}
+
+func (r *countingResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	r.lookups++
+	r.mu.Unlock()
+	if r.block != nil {
+		<-r.block
+	}
+	return r.ips, r.err
+}
+
+func (r *countingResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+// ttlCountingResolver is a countingResolver that tells the TTL of its
+// answers.
+type ttlCountingResolver struct {
+	countingResolver
+	ttl time.Duration
+}
+
+func (r *ttlCountingResolver) lookupTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	ips, err := r.LookupIP(ctx, network, host)
+	return ips, r.ttl, err
+}
+
+var notFound = &net.DNSError{Err: "no such host", Name: "nx.test", IsNotFound: true}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	ips := []net.IP{net.ParseIP("192.0.2.1")}
+
+	// Answers are kept for their TTL.
+	r := &ttlCountingResolver{countingResolver: countingResolver{ips: ips}, ttl: 50 * time.Millisecond}
+	c := &Cache{Resolver: r}
+	for i := 0; i < 3; i++ {
+		got, err := c.LookupIP(ctx, "ip", "a.test")
+		if err != nil || !reflect.DeepEqual(got, ips) {
+			t.Fatalf("LookupIP = %v, %v", got, err)
+		}
+	}
+	c.LookupIP(ctx, "ip", "A.test.")
+	if n := r.count(); n != 1 {
+		t.Errorf("resolved %d times, want 1", n)
+	}
+	c.LookupIP(ctx, "ip4", "a.test")
+	if n := r.count(); n != 2 {
+		t.Errorf("resolved %d times, want a lookup per network", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	c.LookupIP(ctx, "ip", "a.test")
+	if n := r.count(); n != 3 {
+		t.Errorf("resolved %d times, want the answer to expire", n)
+	}
+
+	// MaxTTL caps the TTL, and a resolver that does not tell gets TTL.
+	r.ttl = time.Hour
+	c = &Cache{Resolver: r, MaxTTL: time.Nanosecond}
+	c.LookupIP(ctx, "ip", "a.test")
+	time.Sleep(time.Millisecond)
+	c.LookupIP(ctx, "ip", "a.test")
+	if n := r.count(); n != 5 {
+		t.Errorf("resolved %d times, want MaxTTL to apply", n-3)
+	}
+	plain := &countingResolver{ips: ips}
+	c = &Cache{Resolver: plain, TTL: time.Nanosecond}
+	c.LookupIP(ctx, "ip", "a.test")
+	time.Sleep(time.Millisecond)
+	c.LookupIP(ctx, "ip", "a.test")
+	if n := plain.count(); n != 2 {
+		t.Errorf("resolved %d times, want TTL to apply", n)
+	}
+
+	// Names not found are kept, other failures are not.
+	for _, tt := range []struct {
+		err     error
+		lookups int
+	}{
+		{notFound, 1},
+		{&net.DNSError{Err: "i/o timeout", Name: "a.test", IsTimeout: true}, 3},
+		{errors.New("failed"), 3},
+	} {
+		r := &countingResolver{err: tt.err}
+		c := &Cache{Resolver: r}
+		for i := 0; i < 3; i++ {
+			if _, err := c.LookupIP(ctx, "ip", "a.test"); err != tt.err {
+				t.Fatalf("LookupIP = %v, want %v", err, tt.err)
+			}
+		}
+		if n := r.count(); n != tt.lookups {
+			t.Errorf("%v: resolved %d times, want %d", tt.err, n, tt.lookups)
+		}
+	}
+	negative := &ttlCountingResolver{countingResolver: countingResolver{err: notFound}, ttl: -1}
+	c = &Cache{Resolver: negative, NegativeTTL: time.Nanosecond}
+	c.LookupIP(ctx, "ip", "nx.test")
+	time.Sleep(time.Millisecond)
+	c.LookupIP(ctx, "ip", "nx.test")
+	if n := negative.count(); n != 2 {
+		t.Errorf("resolved %d times, want NegativeTTL to apply", n)
+	}
+
+	// Concurrent lookups share one, and a lookup gives up with its
+	// context.
+	r = &ttlCountingResolver{countingResolver: countingResolver{ips: ips, block: make(chan struct{})}, ttl: time.Minute}
+	c = &Cache{Resolver: r}
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.LookupIP(short, "ip", "a.test"); err != context.DeadlineExceeded {
+		t.Errorf("LookupIP = %v, want %v", err, context.DeadlineExceeded)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := c.LookupIP(ctx, "ip", "a.test"); err != nil || !reflect.DeepEqual(got, ips) {
+				t.Errorf("LookupIP = %v, %v", got, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(r.block)
+	wg.Wait()
+	if n := r.count(); n != 1 {
+		t.Errorf("resolved %d times, want 1", n)
+	}
+
+	// Size bounds the names kept.
+	c = &Cache{Resolver: &countingResolver{ips: ips}, Size: 2}
+	for _, host := range []string{"a.test", "b.test", "c.test"} {
+		c.LookupIP(ctx, "ip", host)
+	}
+	c.mu.Lock()
+	if len(c.entries) > 2 {
+		t.Errorf("%d names kept, want at most 2", len(c.entries))
+	}
+	c.mu.Unlock()
+}
+
+func TestHostsResolver(t *testing.T) {
+	path := t.TempDir() + "/hosts"
+	hosts := "# static names\n" +
+		"10.1.2.3     db.internal.example db  # primary\n" +
+		"\n" +
+		"2001:db8::1  DB.internal.example.\n" +
+		"fe80::1%lo0  link.local\n"
+	if err := os.WriteFile(path, []byte(hosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]net.IP{
+		"db.internal.example": {net.ParseIP("10.1.2.3"), net.ParseIP("2001:db8::1")},
+		"db":                  {net.ParseIP("10.1.2.3")},
+		"link.local":          {net.ParseIP("fe80::1")},
+	}
+	if !reflect.DeepEqual(r.Hosts, want) {
+		t.Errorf("LoadHosts = %v, want %v", r.Hosts, want)
+	}
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		network, host string
+		want          []net.IP
+	}{
+		{"ip", "Db.Internal.Example", want["db.internal.example"]},
+		{"ip4", "db.internal.example", want["db"]},
+		{"ip6", "db.internal.example", []net.IP{net.ParseIP("2001:db8::1")}},
+		{"ip6", "db", nil},
+	} {
+		got, err := r.LookupIP(ctx, tt.network, tt.host)
+		if tt.want == nil {
+			if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+				t.Errorf("LookupIP(%s, %s) = %v, %v, want not found", tt.network, tt.host, got, err)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LookupIP(%s, %s) = %v, %v, want %v", tt.network, tt.host, got, err, tt.want)
+		}
+	}
+
+	// Other names go to the fallback.
+	fallback := &countingResolver{ips: []net.IP{net.ParseIP("192.0.2.1")}}
+	r.Fallback = fallback
+	if got, err := r.LookupIP(ctx, "ip", "example.com"); err != nil || !reflect.DeepEqual(got, fallback.ips) {
+		t.Errorf("LookupIP(example.com) = %v, %v, want the fallback's", got, err)
+	}
+	r.LookupIP(ctx, "ip", "db")
+	if n := fallback.count(); n != 1 {
+		t.Errorf("fallback resolved %d names, want 1", n)
+	}
+
+	for n, line := range []string{"10.1.2.3", "db.example 10.1.2.3"} {
+		if err := os.WriteFile(path, []byte("10.0.0.1 ok\n"+line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadHosts(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+			t.Errorf("LoadHosts error %d = %v, want one for line 2", n, err)
+		}
+	}
+}
+
+func TestParseResolver(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Resolver
+	}{
+		{"system", net.DefaultResolver},
+		{"8.8.8.8", &DNSResolver{Addr: "8.8.8.8:53"}},
+		{"2001:db8::53", &DNSResolver{Addr: "[2001:db8::53]:53"}},
+		{"udp://dns.example:5353", &DNSResolver{Addr: "dns.example:5353"}},
+		{"tcp://[2001:db8::53]", &DNSResolver{Addr: "[2001:db8::53]:53", TCP: true}},
+		{"https://dns.example/dns-query", &DoHResolver{URL: "https://dns.example/dns-query"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseResolver(tt.s)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseResolver(%q) = %+v, %v, want %+v", tt.s, got, err, tt.want)
+		}
+	}
+
+	for _, s := range []string{"", "dns.example", "udp://", "udp://dns.example/path", "ftp://dns.example"} {
+		if _, err := ParseResolver(s); err == nil {
+			t.Errorf("ParseResolver(%q) succeeded", s)
+		}
+	}
+}
+
+// TestServerResolver resolves the domain names of SOCKS5 and SOCKS4A
+// requests with the Resolver of the server.
+func TestServerResolver(t *testing.T) {
+	echo := startEcho(t, "tcp4").(*net.TCPAddr)
+	resolver := &HostsResolver{Hosts: map[string][]net.IP{"echo.test": {net.ParseIP("127.0.0.1")}}}
+	proxy := serve(t, "tcp4", &Server{
+		Authenticators: []Authenticator{NoAuth{}},
+		Guard:          allowLoopback,
+		Resolver:       &Cache{Resolver: resolver},
+		Logger:         log.New(io.Discard, "", 0),
+	})
+
+	for host, want := range map[string]byte{"echo.test": 0x00, "nx.test": 0x04} {
+		conn, err := net.Dial("tcp", proxy.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := (&Method5Request{Methods: []byte{0x00}}).WriteBinary(conn); err != nil {
+			t.Fatal(err)
+		}
+		if err := new(Method5Reply).ReadBinary(conn); err != nil {
+			t.Fatal(err)
+		}
+		req := &Socks5Request{Version: 0x05, Command: CmdConnect, AddressType: 0x03, Domain: host, Port: uint16(echo.Port)}
+		if err := req.WriteBinary(conn); err != nil {
+			t.Fatal(err)
+		}
+		rep := new(Socks5Reply)
+		if err := rep.ReadBinary(conn); err != nil || rep.Reply != want {
+			t.Fatalf("SOCKS5 %s: reply %+v, %v, want %#02x", host, rep, err, want)
+		}
+		if want == 0x00 {
+			checkEcho(t, conn)
+		}
+		conn.Close()
+
+		conn, err = net.Dial("tcp", proxy.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req4 := &Socks4Request{Command: CmdConnect, Address: net.IPv4(0, 0, 0, 1).To4(), Domain: host, Port: uint16(echo.Port)}
+		if err := req4.WriteBinary(conn); err != nil {
+			t.Fatal(err)
+		}
+		rep4 := new(Socks4Reply)
+		if want4 := map[byte]byte{0x00: 90, 0x04: 91}[want]; rep4.ReadBinary(conn) != nil || rep4.Command != want4 {
+			t.Fatalf("SOCKS4A %s: reply %+v, want %d", host, rep4, want4)
+		}
+		if want == 0x00 {
+			checkEcho(t, conn)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,208 @@
+package gator
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Router is a Dialer that sends each destination along the first route
+// that matches it. Destinations no route matches are connected directly.
+type Router struct {
+	Routes []Route
+
+	// Direct connects the destinations of direct routes, a DirectDialer
+	// checking addresses with DefaultGuard if nil. Server.Guard does not
+	// apply to a Router, give Direct a Control to check addresses.
+	Direct Dialer
+
+	// Logger receives the route each connection takes. If nil, the route
+	// goes to the log of the Server dialing, along with its client, or
+	// to the standard logger.
+	Logger *log.Logger
+}
+
+// Route matches destinations like the destination conditions of a Rule. An
+// empty condition matches any destination. Domain names are not resolved to
+// match Destinations.
+type Route struct {
+	Destinations []*net.IPNet
+	Domains      []string
+	Ports        []PortRange
+
+	// Via is how the destinations are reached: RouteDirect, RouteReject or
+	// the URLs of upstream proxies, see ParseUpstreams. It names the route
+	// in the log, without passwords.
+	Via string
+
+	// Dialer connects through the upstreams of Via, a Pool if there are
+	// several.
+	Dialer Dialer
+}
+
+// Special values of Route.Via.
+const (
+	RouteDirect = "direct"
+	RouteReject = "reject"
+)
+
+func (r *Router) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	p, _ := strconv.Atoi(port)
+
+	route := r.route(host, p)
+	via := RouteDirect
+	if route != nil {
+		via = route.name()
+	}
+	r.logRoute(ctx, address, via)
+
+	switch {
+	case via == RouteReject:
+		return nil, fmt.Errorf("%w: %s is rejected by routing", errNotAllowed, address)
+	case route != nil && route.Dialer != nil:
+		return route.Dialer.DialContext(ctx, network, address)
+	case r.Direct != nil:
+		return r.Direct.DialContext(ctx, network, address)
+	}
+	d := &DirectDialer{Control: DefaultGuard.Control}
+	return d.DialContext(ctx, network, address)
+}
+
+// route returns the first route that matches host and port, nil if none.
+func (r *Router) route(host string, port int) *Route {
+	rule := new(Rule)
+	for i := range r.Routes {
+		route := &r.Routes[i]
+		rule.Destinations, rule.Domains, rule.Ports = route.Destinations, route.Domains, route.Ports
+		if rule.matchDestination(host) && rule.matchPort(port) {
+			return route
+		}
+	}
+	return nil
+}
+
+// name returns Via without the passwords of upstreams.
+func (route *Route) name() string {
+	names := strings.Split(route.Via, ",")
+	for i, s := range names {
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			names[i] = u.Redacted()
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// logRoute logs that address is reached via via, naming the client and
+// user when a Server dials.
+func (r *Router) logRoute(ctx context.Context, address, via string) {
+	format, v := "route %s via %s", []interface{}{address, via}
+	if s := sessionOf(ctx); s != nil {
+		format += " for %s, user: %s"
+		v = append(v, s.source, s.identity)
+		if r.Logger == nil {
+			s.server.logf(format, v...)
+			return
+		}
+	}
+	if r.Logger != nil {
+		r.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// LoadRoutes reads a file of routes, one per line, tried in order. A route
+// is a list of conditions followed by "via" and how to reach the
+// destinations it matches:
+//
+//	to 10.0.0.0/8,.corp.example      destination networks, addresses or domains
+//	port 80,443,8000-8999            destination ports
+//	via socks5://corp:1080           direct, reject or upstream URLs
+//	balance least-connections        how to pick among several upstreams
+//
+// A route without conditions matches every destination. Blank lines and
+// lines starting with # are ignored.
+func LoadRoutes(path string) ([]Route, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var routes []Route
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		route, err := ParseRoute(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, scanner.Err()
+}
+
+// ParseRoute parses a single route in the format of LoadRoutes.
+func ParseRoute(line string) (Route, error) {
+	var route Route
+
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return route, fmt.Errorf("condition %q without a value", fields[len(fields)-1])
+	}
+
+	rule := new(Rule)
+	balance := RoundRobin
+	for i := 0; i < len(fields); i += 2 {
+		switch key, value := fields[i], fields[i+1]; key {
+		case "to", "port":
+			for _, v := range strings.Split(value, ",") {
+				if err := rule.add(key, v); err != nil {
+					return route, err
+				}
+			}
+		case "via":
+			if route.Via != "" {
+				return route, errors.New("more than one via")
+			}
+			route.Via = value
+		case "balance":
+			b, err := ParseBalance(value)
+			if err != nil {
+				return route, err
+			}
+			balance = b
+		default:
+			return route, fmt.Errorf("unknown condition %q", key)
+		}
+	}
+	route.Destinations, route.Domains, route.Ports = rule.Destinations, rule.Domains, rule.Ports
+
+	switch route.Via {
+	case "":
+		return route, errors.New("no via")
+	case RouteDirect, RouteReject:
+	default:
+		d, err := ParseUpstreams(route.Via, balance)
+		if err != nil {
+			return route, err
+		}
+		route.Dialer = d
+	}
+	return route, nil
+}
@@ -0,0 +1,183 @@
+package gator
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mustParseRoute(t *testing.T, line string) Route {
+	t.Helper()
+	route, err := ParseRoute(line)
+	if err != nil {
+		t.Fatalf("ParseRoute(%q): %s", line, err)
+	}
+	return route
+}
+
+func TestRouter(t *testing.T) {
+	upstream, upstreamDialed := startUpstream(t, &UserPassAuth{Credentials: StaticCredentials{"alice": "secret"}})
+	direct := new(pipeDialer)
+
+	var logged bytes.Buffer
+	r := &Router{
+		Routes: []Route{
+			mustParseRoute(t, "to .internal.example via direct"),
+			mustParseRoute(t, "to *.corp.example via socks5://alice:secret@"+upstream.String()),
+			mustParseRoute(t, "to 203.0.113.0/24 via reject"),
+			mustParseRoute(t, "port 25 via reject"),
+		},
+		Direct: direct,
+		Logger: log.New(&logged, "", 0),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, address := range []string{"db.internal.example:5432", "git.corp.example:22", "example.com:80"} {
+		conn, err := r.DialContext(ctx, "tcp", address)
+		if err != nil {
+			t.Fatalf("%s: %s", address, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		checkEcho(t, conn)
+		conn.Close()
+	}
+	for _, address := range []string{"203.0.113.9:443", "mail.example.net:25"} {
+		if _, err := r.DialContext(ctx, "tcp", address); replyCode5(err) != 0x02 {
+			t.Errorf("%s: got %v, want a rejection", address, err)
+		}
+	}
+
+	direct.mu.Lock()
+	if want := []string{"db.internal.example:5432", "example.com:80"}; !reflect.DeepEqual(direct.dialed, want) {
+		t.Errorf("dialed directly %q, want %q", direct.dialed, want)
+	}
+	direct.mu.Unlock()
+	upstreamDialed.mu.Lock()
+	if want := []string{"git.corp.example:22"}; !reflect.DeepEqual(upstreamDialed.dialed, want) {
+		t.Errorf("dialed through the upstream %q, want %q", upstreamDialed.dialed, want)
+	}
+	upstreamDialed.mu.Unlock()
+
+	want := "route db.internal.example:5432 via direct\n" +
+		"route git.corp.example:22 via socks5://alice:xxxxx@" + upstream.String() + "\n" +
+		"route example.com:80 via direct\n" +
+		"route 203.0.113.9:443 via reject\n" +
+		"route mail.example.net:25 via reject\n"
+	if logged.String() != want {
+		t.Errorf("logged\n%s\nwant\n%s", logged.String(), want)
+	}
+}
+
+// TestRouterServer routes the connections of both SOCKS versions, and logs
+// the routes with their clients in the log of the server.
+func TestRouterServer(t *testing.T) {
+	var (
+		logged bytes.Buffer
+		mu     sync.Mutex
+	)
+	s := &Server{
+		Dialer: &Router{
+			Routes: []Route{mustParseRoute(t, "to 192.0.2.0/24 via reject")},
+			Direct: new(pipeDialer),
+		},
+		Authenticators: []Authenticator{NoAuth{}},
+		Logger:         log.New(&lockedWriter{&logged, &mu}, "", 0),
+	}
+	proxy := serve(t, "tcp4", s)
+
+	for ip, want := range map[string]byte{"198.51.100.1": 0x00, "192.0.2.1": 0x02} {
+		dst := &net.TCPAddr{IP: net.ParseIP(ip).To4(), Port: 80}
+
+		conn, err := net.Dial("tcp", proxy.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		rep, err := socks5Connect(conn, dst)
+		conn.Close()
+		if err != nil || rep.Reply != want {
+			t.Errorf("SOCKS5 %s: reply %+v, %v, want %#02x", ip, rep, err, want)
+		}
+
+		conn, err = net.Dial("tcp", proxy.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		rep4, err := socks4Connect(conn, dst)
+		conn.Close()
+		if want4 := map[byte]byte{0x00: 90, 0x02: 91}[want]; err != nil || rep4.Command != want4 {
+			t.Errorf("SOCKS4 %s: reply %+v, %v, want %d", ip, rep4, err, want4)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, want := range []string{"route 198.51.100.1:80 via direct for 127.0.0.1:", "route 192.0.2.1:80 via reject for 127.0.0.1:"} {
+		if n := strings.Count(logged.String(), want); n != 2 {
+			t.Errorf("logged %q %d times, want 2:\n%s", want, n, logged.String())
+		}
+	}
+	if !strings.Contains(logged.String(), ", user: anonymous\n") {
+		t.Errorf("logged no user:\n%s", logged.String())
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	route := mustParseRoute(t, "to 10.0.0.0/8,.corp.example port 80,8000-8999 via http://proxy:3128")
+	if len(route.Destinations) != 1 || !reflect.DeepEqual(route.Domains, []string{".corp.example"}) ||
+		!reflect.DeepEqual(route.Ports, []PortRange{{80, 80}, {8000, 8999}}) {
+		t.Errorf("route = %+v", route)
+	}
+	if _, ok := route.Dialer.(*HTTPDialer); !ok {
+		t.Errorf("dialer = %+v", route.Dialer)
+	}
+	if route := mustParseRoute(t, "via reject"); route.Dialer != nil || route.Via != RouteReject {
+		t.Errorf("route = %+v", route)
+	}
+
+	for _, line := range []string{
+		"",
+		"to .example.com",
+		"to .example.com via",
+		"via direct via reject",
+		"from 10.0.0.0/8 via direct",
+		"to 10.0.0.0/33 via direct",
+		"via gopher://h:70",
+	} {
+		if _, err := ParseRoute(line); err == nil {
+			t.Errorf("ParseRoute(%q) succeeded", line)
+		}
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	path := t.TempDir() + "/routes"
+	if err := os.WriteFile(path, []byte("# corp\nto .corp.example via socks5://corp:1080\n\nvia direct\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := LoadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[1].Via != RouteDirect {
+		t.Fatalf("LoadRoutes = %+v", routes)
+	}
+
+	if err := os.WriteFile(path, []byte("via direct\nvia nowhere\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRoutes(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("LoadRoutes error = %v, want one for line 2", err)
+	}
+}
@@ -0,0 +1,354 @@
+package gator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Action is what a Rule does with the requests it matches.
+type Action int
+
+// Actions of a Rule.
+const (
+	Deny Action = iota
+	Allow
+)
+
+// Rule matches the requests that satisfy all of its conditions. An empty
+// condition matches any request.
+type Rule struct {
+	Action Action
+
+	// Sources are the networks of the clients.
+	Sources []*net.IPNet
+
+	// Destinations are networks of destination IP addresses, and Domains
+	// patterns of destination domain names. When either is set, the
+	// destination must match one of them. Domain names are not resolved to
+	// match Destinations.
+	//
+	// A pattern starting with a dot, such as ".example.com", matches that
+	// domain and all of its subdomains. Other patterns are globs as
+	// understood by path.Match, such as "*.example.com", or plain names.
+	Destinations []*net.IPNet
+	Domains      []string
+
+	// Ports are ranges of destination ports.
+	Ports []PortRange
+
+	// Commands are the commands of the requests, CmdConnect, CmdBind or
+	// CmdAssociate.
+	Commands []byte
+
+	// Users are the names of authenticated users.
+	Users []string
+}
+
+// PortRange is a range of ports, From and To included.
+type PortRange struct {
+	From, To int
+}
+
+// RuleList is a RuleSet that tries its rules in order. The first rule that
+// matches a request decides, Default decides for the requests no rule
+// matches.
+//
+// The setup of a UDP association, which has no destination, is allowed if
+// some of its datagrams could be: a rule with destination or port
+// conditions allows it if it would allow a datagram, and is skipped if it
+// would deny one.
+type RuleList struct {
+	Rules   []Rule
+	Default Action
+}
+
+func (l *RuleList) Allow(r *Request) bool {
+	setup := r.Command == CmdAssociate && r.Host == ""
+	for i := range l.Rules {
+		rule := &l.Rules[i]
+		if setup && rule.hasDestination() {
+			if rule.Action == Allow && rule.matchClient(r) {
+				return true
+			}
+			continue
+		}
+		if rule.Match(r) {
+			return rule.Action == Allow
+		}
+	}
+	return l.Default == Allow
+}
+
+// Match reports whether r satisfies all conditions of the rule.
+func (rule *Rule) Match(r *Request) bool {
+	return rule.matchSource(r.Source) &&
+		rule.matchDestination(r.Host) &&
+		rule.matchPort(r.Port) &&
+		rule.matchCommand(r.Command) &&
+		rule.matchUser(r.Identity)
+}
+
+// matchClient reports whether r satisfies the conditions of the rule that
+// do not depend on the destination.
+func (rule *Rule) matchClient(r *Request) bool {
+	return rule.matchSource(r.Source) &&
+		rule.matchCommand(r.Command) &&
+		rule.matchUser(r.Identity)
+}
+
+// hasDestination reports whether the rule has destination or port
+// conditions.
+func (rule *Rule) hasDestination() bool {
+	return len(rule.Destinations) > 0 || len(rule.Domains) > 0 || len(rule.Ports) > 0
+}
+
+func (rule *Rule) matchSource(addr net.Addr) bool {
+	if len(rule.Sources) == 0 {
+		return true
+	}
+	return containsIP(rule.Sources, addrIP(addr))
+}
+
+func (rule *Rule) matchDestination(host string) bool {
+	if len(rule.Destinations) == 0 && len(rule.Domains) == 0 {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return containsIP(rule.Destinations, ip)
+	}
+	for _, pattern := range rule.Domains {
+		if matchDomain(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matchPort(port int) bool {
+	if len(rule.Ports) == 0 {
+		return true
+	}
+	for _, p := range rule.Ports {
+		if port >= p.From && port <= p.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matchCommand(cmd byte) bool {
+	if len(rule.Commands) == 0 {
+		return true
+	}
+	for _, c := range rule.Commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matchUser(id *Identity) bool {
+	if len(rule.Users) == 0 {
+		return true
+	}
+	if id == nil || id.Name == "" {
+		return false
+	}
+	for _, u := range rule.Users {
+		if u == id.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP address of a TCP or UDP address, nil for any other
+// address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain matches a domain name against a pattern of Rule.Domains,
+// ignoring case and a trailing dot.
+func matchDomain(pattern, name string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if strings.HasPrefix(pattern, ".") {
+		return name == pattern[1:] || strings.HasSuffix(name, pattern)
+	}
+	ok, err := path.Match(pattern, name)
+	return ok && err == nil
+}
+
+// LoadRules reads a file of rules, one per line, tried in order. A rule is
+// "allow" or "deny" followed by conditions:
+//
+//	from 10.0.0.0/8,192.168.1.10     client networks or addresses
+//	to 10.0.0.0/8,.example.com       destination networks, addresses or domains
+//	port 80,443,8000-8999            destination ports
+//	cmd connect,bind,associate       commands
+//	user alice,bob                   authenticated users
+//
+// Requests that no rule matches are denied, end the file with a bare
+// "allow" to allow them instead. Blank lines and lines starting with # are
+// ignored.
+func LoadRules(path string) (*RuleList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := &RuleList{Default: Deny}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		l.Rules = append(l.Rules, rule)
+	}
+	return l, scanner.Err()
+}
+
+// ParseRule parses a single rule in the format of LoadRules.
+func ParseRule(line string) (Rule, error) {
+	var rule Rule
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return rule, errors.New("empty rule")
+	}
+	switch fields[0] {
+	case "allow":
+		rule.Action = Allow
+	case "deny":
+		rule.Action = Deny
+	default:
+		return rule, fmt.Errorf("expected allow or deny, got %q", fields[0])
+	}
+
+	fields = fields[1:]
+	if len(fields)%2 != 0 {
+		return rule, fmt.Errorf("condition %q without a value", fields[len(fields)-1])
+	}
+
+	for i := 0; i < len(fields); i += 2 {
+		for _, value := range strings.Split(fields[i+1], ",") {
+			if err := rule.add(fields[i], value); err != nil {
+				return rule, err
+			}
+		}
+	}
+	return rule, nil
+}
+
+// add adds a single value to the condition key.
+func (rule *Rule) add(key, value string) error {
+	switch key {
+	case "from":
+		n, err := parseNetwork(value)
+		if err != nil {
+			return err
+		}
+		rule.Sources = append(rule.Sources, n)
+	case "to":
+		if strings.Contains(value, "/") || net.ParseIP(value) != nil {
+			n, err := parseNetwork(value)
+			if err != nil {
+				return err
+			}
+			rule.Destinations = append(rule.Destinations, n)
+		} else if _, err := path.Match(value, ""); err == nil && value != "" {
+			rule.Domains = append(rule.Domains, value)
+		} else {
+			return fmt.Errorf("invalid destination %q", value)
+		}
+	case "port":
+		p, err := parsePortRange(value)
+		if err != nil {
+			return err
+		}
+		rule.Ports = append(rule.Ports, p)
+	case "cmd":
+		switch value {
+		case "connect":
+			rule.Commands = append(rule.Commands, CmdConnect)
+		case "bind":
+			rule.Commands = append(rule.Commands, CmdBind)
+		case "associate":
+			rule.Commands = append(rule.Commands, CmdAssociate)
+		default:
+			return fmt.Errorf("unknown command %q", value)
+		}
+	case "user":
+		rule.Users = append(rule.Users, value)
+	default:
+		return fmt.Errorf("unknown condition %q", key)
+	}
+	return nil
+}
+
+// parseNetwork parses a CIDR network, or a single IP address as a network
+// of its own.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parsePortRange parses a port, or a range of ports such as 8000-8999.
+func parsePortRange(s string) (PortRange, error) {
+	from, to := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+
+	f, err1 := strconv.Atoi(from)
+	t, err2 := strconv.Atoi(to)
+	if err1 != nil || err2 != nil || f < 0 || t > 65535 || f > t {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{From: f, To: t}, nil
+}
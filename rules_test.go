@@ -0,0 +1,192 @@
+package gator
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleList(t *testing.T) {
+	var rules []Rule
+	for _, line := range []string{
+		"allow user admin",
+		"deny to 10.0.0.0/8,fd00::/8,169.254.169.254",
+		"deny to .internal.example.com",
+		"allow from 192.168.0.0/16 cmd bind,associate",
+		"deny cmd bind,associate",
+		"deny to *.ads.example.net port 80,443",
+		"allow port 80,443,8000-8999",
+	} {
+		rule, err := ParseRule(line)
+		if err != nil {
+			t.Fatalf("ParseRule(%q): %s", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	l := &RuleList{Rules: rules, Default: Deny}
+
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 40000}
+	lan := &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 40000}
+	admin := &Identity{Name: "admin", Method: 0x02}
+	alice := &Identity{Name: "alice", Method: 0x02}
+
+	tests := []struct {
+		name string
+		req  Request
+		want bool
+	}{
+		{"public host", Request{CmdConnect, client, "192.0.2.1", 443, nil}, true},
+		{"port range", Request{CmdConnect, client, "example.com", 8080, nil}, true},
+		{"port not listed", Request{CmdConnect, client, "example.com", 22, nil}, false},
+		{"private network", Request{CmdConnect, client, "10.1.2.3", 80, alice}, false},
+		{"ULA", Request{CmdConnect, client, "fd12::1", 443, nil}, false},
+		{"metadata service", Request{CmdConnect, client, "169.254.169.254", 80, nil}, false},
+		{"admin goes anywhere", Request{CmdConnect, client, "10.1.2.3", 22, admin}, true},
+		{"internal domain", Request{CmdConnect, client, "internal.example.com", 443, nil}, false},
+		{"internal subdomain", Request{CmdConnect, client, "Wiki.Internal.Example.com.", 443, nil}, false},
+		{"lookalike domain", Request{CmdConnect, client, "notinternal.example.com", 443, nil}, true},
+		{"glob", Request{CmdConnect, client, "x.ads.example.net", 80, nil}, false},
+		{"glob does not match parent", Request{CmdConnect, client, "ads.example.net", 80, nil}, true},
+		{"bind from lan", Request{CmdBind, lan, "192.0.2.1", 0, nil}, true},
+		{"bind from outside", Request{CmdBind, client, "192.0.2.1", 0, nil}, false},
+		{"unix socket source", Request{CmdBind, &net.UnixAddr{Name: "/run/gator.sock", Net: "unix"}, "192.0.2.1", 0, nil}, false},
+		{"associate from lan", Request{CmdAssociate, lan, "", 0, nil}, true},
+		{"associate from outside", Request{CmdAssociate, client, "", 0, nil}, false},
+		{"datagram from lan", Request{CmdAssociate, lan, "192.0.2.1", 53, nil}, true},
+		{"datagram to private network", Request{CmdAssociate, lan, "10.1.2.3", 53, nil}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.Allow(&tt.req); got != tt.want {
+				t.Errorf("Allow(%+v) = %v, want %v", tt.req, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleListDefault(t *testing.T) {
+	r := &Request{Command: CmdConnect, Host: "example.com", Port: 80}
+	if (&RuleList{}).Allow(r) {
+		t.Error("empty RuleList allowed a request")
+	}
+	if !(&RuleList{Default: Allow}).Allow(r) {
+		t.Error("RuleList with Default Allow denied a request")
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, line := range []string{
+		"permit",
+		"allow to",
+		"allow from example.com",
+		"allow to 10.0.0.0/33",
+		"allow to [a-",
+		"allow port 80-70",
+		"allow port 65536",
+		"allow cmd udp",
+		"allow via eth0",
+	} {
+		if _, err := ParseRule(line); err == nil {
+			t.Errorf("ParseRule(%q) succeeded", line)
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	path := t.TempDir() + "/rules"
+	if err := os.WriteFile(path, []byte("# internal networks\ndeny to 10.0.0.0/8\n\nallow\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Rules) != 2 || l.Default != Deny {
+		t.Fatalf("LoadRules = %+v", l)
+	}
+
+	if err := os.WriteFile(path, []byte("deny to 10.0.0.0/8\nallow port http\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRules(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("LoadRules error = %v, want one for line 2", err)
+	}
+}
+
+// TestRuleListAssociate checks the setup of UDP associations, which is
+// allowed when a rule with destination conditions could allow a datagram.
+func TestRuleListAssociate(t *testing.T) {
+	setup := &Request{Command: CmdAssociate, Source: &net.TCPAddr{IP: net.ParseIP("192.0.2.7")}}
+	tests := []struct {
+		rules []string
+		want  bool
+	}{
+		{[]string{"allow port 53"}, true},
+		{[]string{"deny to 10.0.0.0/8", "deny port 53"}, false},
+		{[]string{"deny to 10.0.0.0/8"}, false},
+		{[]string{"deny port 25", "allow"}, true},
+		{[]string{"deny cmd associate", "allow port 53"}, false},
+		{[]string{"allow user bob port 53"}, false},
+		{[]string{"allow from 198.51.100.0/24 port 53"}, false},
+	}
+	for _, tt := range tests {
+		l := &RuleList{}
+		for _, line := range tt.rules {
+			rule, err := ParseRule(line)
+			if err != nil {
+				t.Fatalf("ParseRule(%q): %s", line, err)
+			}
+			l.Rules = append(l.Rules, rule)
+		}
+		if got := l.Allow(setup); got != tt.want {
+			t.Errorf("rules %q: Allow(setup) = %v, want %v", tt.rules, got, tt.want)
+		}
+	}
+}
+
+// TestRulesUDPAssociate allows UDP to a single port: the association is set
+// up and only the datagrams to that port are relayed. Denying the command
+// refuses the association itself.
+func TestRulesUDPAssociate(t *testing.T) {
+	allowed, denied := startUDPEcho(t), startUDPEcho(t)
+	rule, err := ParseRule("allow cmd associate port " + strconv.Itoa(allowed.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := serve(t, "tcp4", &Server{
+		Authenticators: []Authenticator{NoAuth{}},
+		Guard:          allowLoopback,
+		Rules:          &RuleList{Rules: []Rule{rule}, Default: Deny},
+	})
+
+	c := associate(t, proxy, true)
+	c.send(0, denied, "denied")
+	c.send(0, allowed, "allowed")
+	c.expect(allowed, "allowed")
+	if ur := c.receive(200 * time.Millisecond); ur != nil {
+		t.Fatalf("relayed a denied datagram: %+v", ur)
+	}
+
+	rule, err = ParseRule("deny cmd associate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy = serve(t, "tcp4", &Server{
+		Authenticators: []Authenticator{NoAuth{}},
+		Guard:          allowLoopback,
+		Rules:          &RuleList{Rules: []Rule{rule}, Default: Allow},
+	})
+	conn := dialProxy(t, proxy)
+	rep, err := socks5Command(conn, CmdAssociate, net.IPv4zero, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Reply != 0x02 {
+		t.Fatalf("reply %#02x to a denied association, want 0x02", rep.Reply)
+	}
+}
@@ -0,0 +1,468 @@
+package gator
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Commands of a Request, with the values SOCKS uses for them. HTTP requests
+// are all CmdConnect.
+const (
+	CmdConnect   = 0x01
+	CmdBind      = 0x02
+	CmdAssociate = 0x03
+)
+
+// Protocol is a set of protocols a Server speaks.
+type Protocol int
+
+// Protocols of a Server.
+const (
+	SOCKS4 Protocol = 1 << iota // SOCKS4 and SOCKS4A
+	SOCKS5
+	HTTP
+)
+
+var protocolNames = []struct {
+	p    Protocol
+	name string
+}{
+	{SOCKS4, "socks4"},
+	{SOCKS5, "socks5"},
+	{HTTP, "http"},
+}
+
+func (p Protocol) String() string {
+	var names []string
+	for _, n := range protocolNames {
+		if p&n.p != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseProtocols parses a comma separated list of the protocols socks4,
+// socks5 and http.
+func ParseProtocols(list string) (Protocol, error) {
+	var p Protocol
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		found := false
+		for _, n := range protocolNames {
+			if strings.EqualFold(s, n.name) {
+				p |= n.p
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown protocol %q", s)
+		}
+	}
+	return p, nil
+}
+
+// Server serves SOCKS4, SOCKS4A, SOCKS5 and HTTP proxy clients. The zero
+// value serves nobody, at least one Authenticator is needed, use NoAuth
+// to allow anonymous clients. A Server must not be copied after first use.
+type Server struct {
+	// Addr is the TCP address ListenAndServe listens on, ":1080" if empty.
+	Addr string
+
+	// Protocols are the protocols clients may speak, all of them if zero.
+	Protocols Protocol
+
+	// Dialer opens the connections to destinations, a DirectDialer with
+	// Resolver if nil.
+	Dialer Dialer
+
+	// Resolver resolves the domain names of requests when the server
+	// connects to destinations itself, of UDP datagrams and of BIND
+	// requests. The system resolver if nil, wrap it in a Cache to cache
+	// the answers.
+	Resolver Resolver
+
+	// Family and Stagger choose among the addresses of destinations the
+	// server connects to itself, see DirectDialer. Family also chooses the
+	// address UDP datagrams to a domain name are sent to.
+	Family  AddressFamily
+	Stagger time.Duration
+
+	// Egress is where the connections to destinations and upstreams, and
+	// the UDP datagrams relayed, leave the host from, the system's choice
+	// if zero. UserEgress replaces it for the clients authenticated as its
+	// user names. Neither applies to BIND requests, which wait for a
+	// connection in, or to a Dialer that does not connect with a
+	// DirectDialer or an upstream dialer of this package.
+	Egress     Egress
+	UserEgress map[string]Egress
+
+	// Guard checks the IP address of every connection to a destination
+	// the server opens itself, that is when Dialer is nil, and of every
+	// UDP datagram it relays. DefaultGuard if nil, use an empty Guard to
+	// allow any address.
+	Guard *Guard
+
+	// ConnectTimeout limits how long a connection to a destination may
+	// take to establish. Zero means no limit.
+	ConnectTimeout time.Duration
+
+	// Authenticators in order of preference.
+	Authenticators []Authenticator
+
+	// Rules decides which requests are served, all of them if nil.
+	Rules RuleSet
+
+	// Logger receives the log of every session, the standard logger if
+	// nil.
+	Logger *log.Logger
+
+	// BindTimeout limits how long a BIND request waits for the application
+	// server to connect. Zero means no limit.
+	BindTimeout time.Duration
+
+	// HandshakeTimeout limits how long a client may take to send each
+	// message of its handshake, and how long an HTTP connection is kept
+	// alive between requests. Zero means no limit.
+	HandshakeTimeout time.Duration
+
+	mu        sync.Mutex
+	shutdown  bool
+	listeners map[net.Listener]struct{}
+	// conns maps every session to whether it is idle, that is waiting for
+	// the next request on a kept alive HTTP connection.
+	conns map[net.Conn]bool
+}
+
+// Dialer opens connections to destinations. *net.Dialer implements it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// RuleSet decides whether a request is allowed.
+type RuleSet interface {
+	Allow(r *Request) bool
+}
+
+// Request is a client request in a form common to all protocols.
+type Request struct {
+	// Command is one of CmdConnect, CmdBind and CmdAssociate.
+	Command byte
+
+	// Source is the address of the client.
+	Source net.Addr
+
+	// Host is the domain name or IP address of the destination. It is
+	// empty, and Port 0, when a UDP association is set up; the datagrams
+	// relayed are then checked with their own destinations.
+	Host string
+	Port int
+
+	// Identity is who the client authenticated as.
+	Identity *Identity
+}
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown.
+var ErrServerClosed = errors.New("gator: Server closed")
+
+// errNotAllowed is returned by handlers when Rules reject a request.
+var errNotAllowed = errors.New("request not allowed by ruleset")
+
+// errHungUp is returned by dial when the client went away first.
+var errHungUp = errors.New("client hung up")
+
+// ListenAndServe listens on the TCP address s.Addr and serves the
+// connections it accepts.
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":1080"
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln and serves each of them in a new
+// goroutine. It returns ErrServerClosed after Shutdown.
+func (s *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+
+	if !s.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+
+	for {
+		c, err := ln.Accept()
+		if s.shuttingDown() {
+			if c != nil {
+				c.Close()
+			}
+			return ErrServerClosed
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			s.logf("Failed to accept connection: %s", err.Error())
+			continue
+		}
+		go func() {
+			if s.ServeConn(c) != nil {
+				c.Close()
+			}
+		}()
+	}
+}
+
+// ServeConn serves a single client, whichever protocol it speaks, and
+// closes the connection when done. After Shutdown it returns
+// ErrServerClosed and leaves the connection open, for another server to
+// serve.
+func (s *Server) ServeConn(client net.Conn) error {
+	// Peek at the first byte to tell the protocols apart, the HTTP proxy
+	// needs it back as part of the request line.
+	bc := &bufferedConn{Conn: client, r: bufio.NewReader(client)}
+	if !s.trackConn(bc, true) {
+		return ErrServerClosed
+	}
+	defer s.trackConn(bc, false)
+	defer client.Close()
+
+	if s.HandshakeTimeout > 0 {
+		client.SetReadDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+	ver, err := bc.r.Peek(1)
+	if err != nil {
+		s.logf("MethodRequest packet is too short")
+		return nil
+	}
+
+	var proxy SockProxy
+	var protocol Protocol
+
+	switch {
+	case ver[0] == 0x04:
+		bc.r.Discard(1)
+		proxy, protocol = NewSock4(s), SOCKS4
+	case ver[0] == 0x05:
+		bc.r.Discard(1)
+		proxy, protocol = NewSock5(s), SOCKS5
+	case isHTTP(ver[0]):
+		proxy, protocol = NewHTTPProxy(s), HTTP
+	default:
+		s.logf("invalid socks version: %v", ver)
+		return nil
+	}
+
+	if s.Protocols != 0 && s.Protocols&protocol == 0 {
+		s.logf("%s is not served, closing %s", protocol, client.RemoteAddr())
+		return nil
+	}
+
+	if err := proxy.Proxy(bc); err != nil {
+		s.logf("Proxy error: %s", err)
+	}
+	return nil
+}
+
+// Shutdown stops accepting new connections and waits for the sessions in
+// progress to finish. Idle HTTP connections are closed right away. When ctx
+// is done before all sessions finished, the remaining ones are cut and
+// Shutdown returns their number along with the context's error.
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	s.shutdown = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if s.closeConns(false) == 0 {
+			return 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			return s.closeConns(true), ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeConns closes the idle sessions, or all of them if active is set,
+// and returns how many sessions are left open or were closed while active.
+func (s *Server) closeConns(active bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for c, idle := range s.conns {
+		if idle || active {
+			c.Close()
+			delete(s.conns, c)
+		}
+		if !idle {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+// trackListener adds or removes ln from the listeners closed by Shutdown.
+// It reports false if the server is already shutting down.
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.listeners, ln)
+		return true
+	}
+	if s.shutdown {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes a session. It reports false if the server is
+// already shutting down.
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.shutdown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	s.conns[c] = false
+	return true
+}
+
+// setIdle marks a session as waiting for its next request, or not. Idle
+// sessions are closed as soon as Shutdown is called.
+func (s *Server) setIdle(c net.Conn, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.conns[c]; !ok {
+		return false
+	}
+	if idle && s.shutdown {
+		return false
+	}
+	s.conns[c] = idle
+	return true
+}
+
+// dial connects to address on behalf of client, authenticated as id. The
+// dial is given up when the client hangs up.
+func (s *Server) dial(client net.Conn, id *Identity, network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hungUp := watchHangup(client, cancel)
+	server, err := s.dialContext(ctx, client.RemoteAddr(), id, network, address)
+	if hungUp() {
+		if server != nil {
+			server.Close()
+		}
+		return nil, errHungUp
+	}
+	return server, err
+}
+
+// dialContext dials through s.Dialer from the Egress of id, giving up after
+// ConnectTimeout, for the client at source.
+func (s *Server) dialContext(ctx context.Context, source net.Addr, id *Identity, network, address string) (net.Conn, error) {
+	if s.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ConnectTimeout)
+		defer cancel()
+	}
+	ctx = withEgress(ctx, s.egress(id))
+	ctx = context.WithValue(ctx, sessionKey{}, &session{server: s, source: source, identity: id})
+
+	if s.Dialer == nil {
+		d := &DirectDialer{Resolver: s.Resolver, Family: s.Family, Stagger: s.Stagger, Control: s.guard().Control}
+		return d.DialContext(ctx, network, address)
+	}
+	return s.Dialer.DialContext(ctx, network, address)
+}
+
+type sessionKey struct{}
+
+// session is the client a dial is made for, so that the dialers of this
+// package can log their decisions with the server's log of it.
+type session struct {
+	server   *Server
+	source   net.Addr
+	identity *Identity
+}
+
+// sessionOf returns the session of ctx, nil if it has none.
+func sessionOf(ctx context.Context) *session {
+	s, _ := ctx.Value(sessionKey{}).(*session)
+	return s
+}
+
+// egress returns where the connections of a client authenticated as id
+// leave from.
+func (s *Server) egress(id *Identity) Egress {
+	if id != nil && id.Name != "" {
+		if e, ok := s.UserEgress[id.Name]; ok {
+			return e
+		}
+	}
+	return s.Egress
+}
+
+func (s *Server) guard() *Guard {
+	if s.Guard == nil {
+		return DefaultGuard
+	}
+	return s.Guard
+}
+
+func (s *Server) allow(r *Request) bool {
+	return s.Rules == nil || s.Rules.Allow(r)
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,581 @@
+package gator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listenLoopback listens on the loopback address of family, skipping the
+// test when the host has no such address.
+func listenLoopback(t *testing.T, family string) net.Listener {
+	t.Helper()
+	addr := "127.0.0.1:0"
+	if family == "tcp6" {
+		addr = "[::1]:0"
+	}
+	ln, err := net.Listen(family, addr)
+	if err != nil {
+		t.Skipf("%s loopback unavailable: %s", family, err)
+	}
+	return ln
+}
+
+// startEcho runs a server that writes back whatever it reads.
+func startEcho(t *testing.T, family string) net.Addr {
+	t.Helper()
+	ln := listenLoopback(t, family)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr()
+}
+
+// allowLoopback lets the proxies of the tests reach their echo servers.
+var allowLoopback = &Guard{Deny: DefaultDeny, Allow: mustParseNetworks("127.0.0.0/8", "::1")}
+
+// startServer runs an anonymous proxy on the loopback address of family.
+func startServer(t *testing.T, family string) net.Addr {
+	t.Helper()
+	return serve(t, family, &Server{Authenticators: []Authenticator{NoAuth{}}, Guard: allowLoopback})
+}
+
+// serve runs s on the loopback address of family until the test ends.
+func serve(t *testing.T, family string, s *Server) net.Addr {
+	t.Helper()
+	ln := listenLoopback(t, family)
+
+	go s.Serve(ln)
+	t.Cleanup(func() {
+		// Cut the sessions rather than wait for them.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		s.Shutdown(ctx)
+	})
+	return ln.Addr()
+}
+
+// socks5Connect runs a SOCKS5 CONNECT to dst and returns the reply.
+func socks5Connect(conn net.Conn, dst *net.TCPAddr) (*Socks5Reply, error) {
+	return socks5Command(conn, CmdConnect, dst.IP, dst.Port)
+}
+
+// socks5Command runs an anonymous SOCKS5 request of cmd with the address
+// ip:port and returns the first reply.
+func socks5Command(conn net.Conn, cmd byte, ip net.IP, port int) (*Socks5Reply, error) {
+	mr := &Method5Request{Methods: []byte{0x00}}
+	if err := mr.WriteBinary(conn); err != nil {
+		return nil, err
+	}
+	mrep := new(Method5Reply)
+	if err := mrep.ReadBinary(conn); err != nil {
+		return nil, err
+	}
+	if mrep.Method != 0x00 {
+		return nil, fmt.Errorf("method %#02x selected", mrep.Method)
+	}
+
+	req := &Socks5Request{Version: 0x05, Command: cmd, AddressType: 0x01, Address: ip, Port: uint16(port)}
+	if ip.To4() == nil {
+		req.AddressType = 0x04
+	}
+	if err := req.WriteBinary(conn); err != nil {
+		return nil, err
+	}
+
+	rep := new(Socks5Reply)
+	return rep, rep.ReadBinary(conn)
+}
+
+// socks4Connect runs a SOCKS4 CONNECT to dst, as SOCKS4A with the IP as the
+// domain name when dst is an IPv6 address.
+func socks4Connect(conn net.Conn, dst *net.TCPAddr) (*Socks4Reply, error) {
+	req := &Socks4Request{Command: CmdConnect, Address: dst.IP, Port: uint16(dst.Port)}
+	if dst.IP.To4() == nil {
+		req.Domain = dst.IP.String()
+	}
+	if err := req.WriteBinary(conn); err != nil {
+		return nil, err
+	}
+
+	rep := new(Socks4Reply)
+	return rep, rep.ReadBinary(conn)
+}
+
+// httpConnect runs an HTTP CONNECT to host:port.
+func httpConnect(conn net.Conn, host string, port int) (*http.Response, error) {
+	host = net.JoinHostPort(host, strconv.Itoa(port))
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(conn), nil)
+}
+
+func checkEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	msg := []byte("hello through the proxy")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(msg) {
+		t.Fatalf("echo = %q, want %q", got, msg)
+	}
+}
+
+// TestConnectAddressFamilies connects IPv4 and IPv6 clients to IPv4 and IPv6
+// destinations over every protocol.
+func TestConnectAddressFamilies(t *testing.T) {
+	families := []string{"tcp4", "tcp6"}
+
+	for _, client := range families {
+		for _, dst := range families {
+			t.Run(client+"-"+dst, func(t *testing.T) {
+				proxy := startServer(t, client)
+				echo := startEcho(t, dst).(*net.TCPAddr)
+
+				dial := func(t *testing.T) net.Conn {
+					conn, err := net.DialTimeout("tcp", proxy.String(), time.Second)
+					if err != nil {
+						t.Fatal(err)
+					}
+					t.Cleanup(func() { conn.Close() })
+					conn.SetDeadline(time.Now().Add(5 * time.Second))
+					return conn
+				}
+
+				t.Run("socks5", func(t *testing.T) {
+					conn := dial(t)
+					rep, err := socks5Connect(conn, echo)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if rep.Reply != 0x00 {
+						t.Fatalf("reply %#02x, want success", rep.Reply)
+					}
+
+					// BND is the outbound socket, of the destination's family.
+					wantType := byte(0x01)
+					if dst == "tcp6" {
+						wantType = 0x04
+					}
+					if rep.AddressType != wantType || !rep.Address.IsLoopback() || rep.Port == 0 {
+						t.Errorf("BND = type %d %s:%d, want a loopback address of type %d",
+							rep.AddressType, rep.Address, rep.Port, wantType)
+					}
+					checkEcho(t, conn)
+				})
+
+				t.Run("socks4", func(t *testing.T) {
+					conn := dial(t)
+					rep, err := socks4Connect(conn, echo)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if rep.Command != 90 {
+						t.Fatalf("reply %d, want 90", rep.Command)
+					}
+					checkEcho(t, conn)
+				})
+
+				t.Run("http", func(t *testing.T) {
+					conn := dial(t)
+					resp, err := httpConnect(conn, echo.IP.String(), echo.Port)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if resp.StatusCode != http.StatusOK {
+						t.Fatalf("status %s, want 200", resp.Status)
+					}
+					checkEcho(t, conn)
+				})
+			})
+		}
+	}
+}
+
+// servePipe serves one end of a net.Pipe and returns the other.
+func servePipe(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	client, conn := net.Pipe()
+	go s.ServeConn(conn)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+// TestHandshakeSplitWrites sends every handshake one byte at a time, as a
+// client whose messages are split across TCP segments.
+func TestHandshakeSplitWrites(t *testing.T) {
+	echo := startEcho(t, "tcp4").(*net.TCPAddr)
+	s := &Server{
+		Authenticators: []Authenticator{&UserPassAuth{Credentials: StaticCredentials{"alice": "secret"}}, NoAuth{}},
+		Logger:         log.New(io.Discard, "", 0),
+		Guard:          allowLoopback,
+	}
+
+	port := binary.BigEndian.AppendUint16(nil, uint16(echo.Port))
+	tests := []struct {
+		name  string
+		send  []byte
+		reply []byte
+	}{
+		{
+			"socks5",
+			append([]byte{0x05, 0x02, 0x00, 0x02,
+				0x01, 0x05, 'a', 'l', 'i', 'c', 'e', 0x06, 's', 'e', 'c', 'r', 'e', 't',
+				0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1}, port...),
+			[]byte{0x05, 0x02, 0x01, 0x00, 0x05, 0x00},
+		},
+		{
+			"socks4a",
+			append(append([]byte{0x04, 0x01}, port...), 0, 0, 0, 1, 'u', 0, '1', '2', '7', '.', '0', '.', '0', '.', '1', 0),
+			[]byte{0x00, 90},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := servePipe(t, s)
+			go func() {
+				for i := range tt.send {
+					if _, err := conn.Write(tt.send[i : i+1]); err != nil {
+						return
+					}
+				}
+			}()
+
+			got := make([]byte, len(tt.reply))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(tt.reply) {
+				t.Fatalf("reply starts % x, want % x", got, tt.reply)
+			}
+		})
+	}
+}
+
+// TestUnsupportedAddressType checks that a request with an unknown ATYP is
+// answered before the connection is closed.
+func TestUnsupportedAddressType(t *testing.T) {
+	s := &Server{Authenticators: []Authenticator{NoAuth{}}, Logger: log.New(io.Discard, "", 0)}
+	conn := servePipe(t, s)
+
+	go conn.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x02})
+
+	got, _ := io.ReadAll(conn)
+	want := []byte{0x05, 0x00, 0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+	if string(got) != string(want) {
+		t.Fatalf("got % x, want % x", got, want)
+	}
+}
+
+// TestHandshakeTimeout checks that a client that stops in the middle of its
+// handshake is dropped.
+func TestHandshakeTimeout(t *testing.T) {
+	s := &Server{
+		Authenticators:   []Authenticator{NoAuth{}},
+		Logger:           log.New(io.Discard, "", 0),
+		HandshakeTimeout: 50 * time.Millisecond,
+	}
+	conn := servePipe(t, s)
+
+	go conn.Write([]byte{0x05, 0x01, 0x00, 0x05})
+
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("connection not closed: %s", err)
+	}
+	if want := []byte{0x05, 0x00}; string(got) != string(want) {
+		t.Fatalf("got % x, want % x", got, want)
+	}
+}
+
+// TestShutdown checks that Shutdown closes idle HTTP connections at once,
+// lets a relay in progress run until the deadline, and then cuts it.
+func TestShutdown(t *testing.T) {
+	echo := startEcho(t, "tcp4").(*net.TCPAddr)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+
+	s := &Server{Authenticators: []Authenticator{NoAuth{}}, Guard: allowLoopback, Logger: log.New(io.Discard, "", 0)}
+	ln := listenLoopback(t, "tcp4")
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+
+	active := dialProxy(t, ln.Addr())
+	if rep, err := socks5Connect(active, echo); err != nil || rep.Reply != 0x00 {
+		t.Fatalf("connect = %+v, %v", rep, err)
+	}
+	checkEcho(t, active)
+
+	idle := dialProxy(t, ln.Addr())
+	fmt.Fprintf(idle, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", origin.URL, origin.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(idle), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	type result struct {
+		cut int
+		err error
+	}
+	done := make(chan result, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go func() {
+		cut, err := s.Shutdown(ctx)
+		done <- result{cut, err}
+	}()
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve = %v, want ErrServerClosed", err)
+	}
+	idle.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle HTTP connection read = %v, want EOF", err)
+	}
+
+	// The relay goes on until the deadline.
+	checkEcho(t, active)
+	select {
+	case r := <-done:
+		t.Fatalf("Shutdown returned %d, %v before the deadline", r.cut, r.err)
+	default:
+	}
+
+	r := <-done
+	if r.cut != 1 || r.err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %d, %v, want 1 session cut", r.cut, r.err)
+	}
+	if _, err := active.Read(make([]byte, 1)); err == nil {
+		t.Error("relay still open after the deadline")
+	}
+}
+
+// lateListener returns a connection from Accept once it is closed, as a
+// listener does that accepted one just as Shutdown closed it.
+type lateListener struct {
+	net.Listener
+	conn      net.Conn
+	accepting chan struct{}
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func (l *lateListener) Accept() (net.Conn, error) {
+	close(l.accepting)
+	<-l.closed
+	return l.conn, nil
+}
+
+func (l *lateListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+// TestShutdownLateAccept checks that a connection accepted after Shutdown
+// is closed.
+func TestShutdownLateAccept(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	ln := &lateListener{conn: conn, accepting: make(chan struct{}), closed: make(chan struct{})}
+
+	s := &Server{Authenticators: []Authenticator{NoAuth{}}}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+	<-ln.accepting
+
+	if _, err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve = %v, want ErrServerClosed", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection accepted after Shutdown read = %v, want EOF", err)
+	}
+}
+
+// TestShutdownDrains checks that Shutdown returns as soon as the last
+// session finishes.
+func TestShutdownDrains(t *testing.T) {
+	echo := startEcho(t, "tcp4").(*net.TCPAddr)
+	s := &Server{Authenticators: []Authenticator{NoAuth{}}, Guard: allowLoopback, Logger: log.New(io.Discard, "", 0)}
+	ln := listenLoopback(t, "tcp4")
+	go s.Serve(ln)
+
+	conn := dialProxy(t, ln.Addr())
+	if rep, err := socks5Connect(conn, echo); err != nil || rep.Reply != 0x00 {
+		t.Fatalf("connect = %+v, %v", rep, err)
+	}
+	time.AfterFunc(100*time.Millisecond, func() { conn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if cut, err := s.Shutdown(ctx); cut != 0 || err != nil {
+		t.Errorf("Shutdown = %d, %v, want the session to finish", cut, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown took %s after the session finished", elapsed)
+	}
+}
+
+// blockingDialer never connects, it waits for the dial to be given up and
+// sends why to done.
+type blockingDialer struct {
+	done chan error
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	<-ctx.Done()
+	d.done <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+// TestConnectTimeout checks that a dial that outlasts ConnectTimeout is
+// reported as TTL expired to SOCKS5 clients and as failed to SOCKS4 ones.
+func TestConnectTimeout(t *testing.T) {
+	d := &blockingDialer{done: make(chan error, 2)}
+	proxy := serve(t, "tcp4", &Server{
+		Authenticators: []Authenticator{NoAuth{}},
+		Dialer:         d,
+		ConnectTimeout: 50 * time.Millisecond,
+		Logger:         log.New(io.Discard, "", 0),
+	})
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}
+
+	rep5, err := socks5Connect(dialProxy(t, proxy), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep5.Reply != 0x06 {
+		t.Errorf("SOCKS5 reply %#02x, want 0x06", rep5.Reply)
+	}
+	rep4, err := socks4Connect(dialProxy(t, proxy), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep4.Command != 91 {
+		t.Errorf("SOCKS4 reply %d, want 91", rep4.Command)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-d.done; err != context.DeadlineExceeded {
+			t.Errorf("dial ended with %v, want the deadline", err)
+		}
+	}
+}
+
+// TestDialHangUp checks that a dial is given up when its client hangs up.
+func TestDialHangUp(t *testing.T) {
+	d := &blockingDialer{done: make(chan error, 1)}
+	proxy := serve(t, "tcp4", &Server{
+		Authenticators: []Authenticator{NoAuth{}},
+		Dialer:         d,
+		Logger:         log.New(io.Discard, "", 0),
+	})
+
+	conn := dialProxy(t, proxy)
+	go socks5Connect(conn, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80})
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case err := <-d.done:
+		if err != context.Canceled {
+			t.Errorf("dial ended with %v, want it cancelled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("dial not given up after the client hung up")
+	}
+}
+
+// TestHandlers checks that the protocol handlers work on their own: the zero
+// values refuse clients as a zero Server does, and a handler from a
+// constructor serves with the settings of its Server.
+func TestHandlers(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler SockProxy
+		send    string
+		reply   []byte
+	}{
+		{"socks5", new(Sock5), "\x01\x00", []byte{0x05, 0xFF}},
+		{"socks4", new(Sock4), "\x01\x00\x50\x7f\x00\x00\x01\x00", []byte{0x00, 93}},
+		{"http", new(HTTPProxy), "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", []byte("HTTP/1.1 407")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := net.Pipe()
+			defer client.Close()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			go func() {
+				defer conn.Close()
+				tt.handler.Proxy(conn)
+			}()
+
+			if _, err := io.WriteString(client, tt.send); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(tt.reply))
+			if _, err := io.ReadFull(client, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.reply) {
+				t.Fatalf("reply %q, want %q", got, tt.reply)
+			}
+		})
+	}
+
+	echo := startEcho(t, "tcp4").(*net.TCPAddr)
+	s := &Server{Authenticators: []Authenticator{NoAuth{}}, Guard: allowLoopback}
+	client, conn := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		defer conn.Close()
+		// The handler expects the version number to have been read.
+		if _, err := io.ReadFull(conn, make([]byte, 1)); err == nil {
+			NewSock5(s).Proxy(conn)
+		}
+	}()
+	rep, err := socks5Connect(client, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Reply != 0x00 {
+		t.Fatalf("reply %#02x, want success", rep.Reply)
+	}
+	checkEcho(t, client)
+}
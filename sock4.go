@@ -1,12 +1,14 @@
-package main
+package gator
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"strconv"
+	"strings"
 )
 
 /**
@@ -204,15 +206,27 @@ the next-hop SOCKS server.
 
 */
 
+// Sock4 serves a SOCKS4 or SOCKS4A client whose version number has already
+// been read. The zero value serves it as a zero Server would.
 type Sock4 struct {
+	server *Server
+
+	// identity is who the client authenticated as.
+	identity *Identity
+}
+
+// NewSock4 returns a SOCKS4 handler with the settings of s.
+func NewSock4(s *Server) *Sock4 {
+	return &Sock4{server: s}
 }
 
 type Socks4Request struct {
-	version byte
-	command byte
-	address net.IP
-	userid  []byte
-	port    uint16
+	Version byte
+	Command byte
+	Address net.IP
+	Domain  string
+	UserID  []byte
+	Port    uint16
 }
 
 type Socks4Reply struct {
@@ -223,22 +237,68 @@ type Socks4Reply struct {
 }
 
 func (s *Sock4) Proxy(client net.Conn) error {
+	if s.server == nil {
+		s.server = new(Server)
+	}
+	hs := &handshakeReader{conn: client, timeout: s.server.HandshakeTimeout}
+
+	hs.stage(maxSocks4Request)
 	sr := new(Socks4Request)
-	if err := sr.ReadBinary(client); err != nil {
+	if err := sr.ReadBinary(hs); err != nil {
+		// Commands the server does not support are still answered.
+		if errors.Is(err, ErrCommand) {
+			srep := Socks4Reply{Version: 0, Command: 91, Port: sr.Port, Address: net.IPv4zero}
+			srep.WriteBinary(client)
+		}
 		return err
 	}
-	log.Printf("v4 cmd: %d %s:%d\n", sr.command, sr.address, sr.port)
+	hs.done()
+	s.server.logf("v4 cmd: %d %s:%d, domain: %s, userid: %s\n", sr.Command, sr.Address, sr.Port, sr.Domain, sr.UserID)
+
+	identity, err := authenticateUserID(s.server.Authenticators, string(sr.UserID))
+	if err != nil {
+		srep := Socks4Reply{Version: 0, Command: replyCode4(err), Port: sr.Port, Address: sr.Address}
+		srep.WriteBinary(client)
+		return err
+	}
+	s.identity = identity
+
+	req := &Request{
+		Command:  sr.Command,
+		Source:   client.RemoteAddr(),
+		Host:     sr.host(),
+		Port:     int(sr.Port),
+		Identity: identity,
+	}
+	if !s.server.allow(req) {
+		srep := Socks4Reply{Version: 0, Command: 91, Port: sr.Port, Address: sr.Address}
+		srep.WriteBinary(client)
+		return errNotAllowed
+	}
+
+	if sr.Command == 2 {
+		return s.bind(client, sr)
+	}
 
 	srep := Socks4Reply{
 		Version: 0,
 		Command: 90,
-		Port:    sr.port,
-		Address: sr.address,
+		Port:    sr.Port,
+		Address: sr.Address,
 	}
-	address := fmt.Sprintf("%s:%d", sr.address, sr.port)
-	server, err := net.Dial("tcp", address)
-	if err != nil {
-		srep.Command = 92
+	// The domain of a SOCKS4A request is resolved here, on behalf of a
+	// client that could not resolve it, or by the upstream the Dialer
+	// passes it to.
+	address := net.JoinHostPort(sr.host(), strconv.Itoa(int(sr.Port)))
+	server, err := s.server.dial(client, s.identity, "tcp", address)
+	if err == errHungUp {
+		return err
+	}
+	srep.Command = replyCode4(err)
+	if err == nil {
+		srep.setAddress(server.LocalAddr())
+	} else {
+		srep.setAddress(nil)
 	}
 	e := srep.WriteBinary(client)
 
@@ -250,71 +310,202 @@ func (s *Sock4) Proxy(client net.Conn) error {
 		return fmt.Errorf("respond: %s", e)
 	}
 
-	//Buffered so that the other goroutine doesn't deadlock
-	stopChan := make(chan bool, 1)
-	go func() {
-		io.Copy(client, server)
-		stopChan <- true
-	}()
-	go func() {
-		io.Copy(server, client)
-		stopChan <- true
-	}()
-
-	//Wait for either of the copies to stop
-	<-stopChan
+	relay(client, server)
 	return nil
 
 }
 
+// bind waits for the application server to connect back. The first reply
+// carries the address we listen on, the second is sent once the connection
+// from DSTIP is established.
+func (s *Sock4) bind(client net.Conn, sr *Socks4Request) error {
+	srep := Socks4Reply{
+		Version: 0,
+		Command: 90,
+		Port:    sr.Port,
+		Address: sr.Address,
+	}
+
+	ln, err := listenBind(client)
+	if err != nil {
+		srep.Command = 91
+		srep.WriteBinary(client)
+		return fmt.Errorf("Listen: %s", err.Error())
+	}
+	defer ln.Close()
+
+	srep.setAddress(ln.Addr())
+	if err := srep.WriteBinary(client); err != nil {
+		return fmt.Errorf("respond: %s", err)
+	}
+
+	s.server.logf("v4 bind: waiting on %s\n", ln.Addr())
+
+	// If the connection is not established within the time limit the
+	// server closes its connection to the client and gives up.
+	server, err := acceptBind(client, ln, s.server.BindTimeout)
+	if err == errHungUp {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Accept: %s", err.Error())
+	}
+	defer server.Close()
+
+	srep.setAddress(server.RemoteAddr())
+	if !bindPeerAllowed(server.RemoteAddr(), sr.Address, sr.Domain, s.server.Resolver) {
+		srep.Command = 91
+		srep.WriteBinary(client)
+		return fmt.Errorf("bind: unexpected peer %s", server.RemoteAddr())
+	}
+
+	if err := srep.WriteBinary(client); err != nil {
+		return fmt.Errorf("respond: %s", err)
+	}
+
+	relay(client, server)
+	return nil
+}
+
 func (s *Socks4Request) ReadBinary(r io.Reader) (err error) {
-	b := make([]byte, 1)
+	b := make([]byte, 3)
 
-	if n, _ := r.Read(b); n != 1 {
-		return errors.New("Socks4Request input too short")
+	if err := readFull(r, b[:1], "Socks4Request"); err != nil {
+		return err
 	}
 
-	s.command = b[0]
-	if b[0] != 1 {
-		if b[0] == 2 {
-			return errors.New("Unimplemented bind command")
-		}
-		return fmt.Errorf("Invalid command: %d", s.command)
+	s.Command = b[0]
+	if b[0] != 1 && b[0] != 2 {
+		return &ProtocolError{Message: "Socks4Request", Err: fmt.Errorf("%w %d", ErrCommand, s.Command)}
 	}
 
-	if err := binary.Read(r, binary.BigEndian, &s.port); err != nil {
+	if err := readFull(r, b[1:], "Socks4Request"); err != nil {
 		return err
 	}
+	s.Port = binary.BigEndian.Uint16(b[1:])
 
 	address := make([]byte, 4)
-	if n, _ := r.Read(address); n != 4 {
-		return errors.New("Socks4Request address is too short")
+	if err := readFull(r, address, "Socks4Request"); err != nil {
+		return err
 	}
 
-	s.address = address
+	s.Address = address
+
+	if s.UserID, err = readString(r, "Socks4Request USERID"); err != nil {
+		return err
+	}
 
-	// sock4A
-	if s.address.String() == "0.0.0.x" {
-		return errors.New("Unimplemented SOCK 4A protocol")
+	// sock4A, DSTIP is 0.0.0.x with x nonzero and the domain name follows
+	// the USERID
+	if isSocks4A(address) {
+		domain, err := readString(r, "Socks4Request domain")
+		if err != nil {
+			return err
+		}
+		if len(domain) == 0 {
+			return &ProtocolError{Message: "Socks4Request domain", Err: fmt.Errorf("%w: empty", ErrMalformed)}
+		}
+		s.Domain = string(domain)
 	}
 
-	// NULL
-	if n, _ := r.Read(b); n != 1 {
-		return errors.New("Socks4Request input too short")
+	return nil
+}
+
+// WriteBinary writes the whole request, including the version number that
+// ReadBinary expects to have been read already. A request with a Domain is
+// written as SOCKS4A.
+func (s *Socks4Request) WriteBinary(w io.Writer) error {
+	if len(s.UserID) > maxStringLength || len(s.Domain) > maxStringLength {
+		return errors.New("Cannot write Socks4Request, field too long")
 	}
-	if b[0] != 0 {
-		return errors.New("Sock4 protocol errored")
+	if bytes.IndexByte(s.UserID, 0) >= 0 || strings.IndexByte(s.Domain, 0) >= 0 {
+		return errors.New("Cannot write Socks4Request, field contains NULL")
+	}
+
+	address := s.Address.To4()
+	if s.Domain != "" && (address == nil || !isSocks4A(address)) {
+		address = net.IPv4(0, 0, 0, 1).To4()
+	}
+	if address == nil {
+		return fmt.Errorf("Cannot write Socks4Request, Invalid IPv4 address: %s", s.Address)
+	}
+
+	b := make([]byte, 0, 10+len(s.UserID)+len(s.Domain))
+	b = append(b, 0x04, s.Command, byte((s.Port&0xFF00)>>8), byte(s.Port&0xFF))
+	b = append(b, address...)
+	b = append(b, s.UserID...)
+	b = append(b, 0)
+	if s.Domain != "" {
+		b = append(b, s.Domain...)
+		b = append(b, 0)
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("Error writing Socks4Request: %v", err)
 	}
 
 	return nil
 }
 
+// isSocks4A reports whether DSTIP is 0.0.0.x with x nonzero, which announces
+// a domain name after the USERID.
+func isSocks4A(address net.IP) bool {
+	return address[0] == 0 && address[1] == 0 && address[2] == 0 && address[3] != 0
+}
+
+// host returns the SOCKS4A domain name if there is one, DSTIP otherwise.
+func (s *Socks4Request) host() string {
+	if s.Domain != "" {
+		return s.Domain
+	}
+	return s.Address.String()
+}
+
+// maxStringLength bounds the NULL terminated USERID and domain fields.
+const maxStringLength = 255
+
+// readString reads a NULL terminated field of message, without the NULL.
+func readString(r io.Reader, message string) ([]byte, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if err := readFull(r, b, message); err != nil {
+			return nil, err
+		}
+		if b[0] == 0 {
+			return s, nil
+		}
+		if len(s) == maxStringLength {
+			return nil, &ProtocolError{Message: message, Err: fmt.Errorf("%w: longer than %d bytes", ErrMalformed, maxStringLength)}
+		}
+		s = append(s, b[0])
+	}
+}
+
+func (s *Socks4Reply) ReadBinary(r io.Reader) error {
+	b := make([]byte, 8)
+	if err := readFull(r, b, "Socks4Reply"); err != nil {
+		return err
+	}
+
+	s.Version = b[0]
+	s.Command = b[1]
+	s.Port = binary.BigEndian.Uint16(b[2:4])
+	s.Address = net.IP(b[4:8])
+
+	return nil
+}
+
 func (s *Socks4Reply) WriteBinary(w io.Writer) error {
 	var b []byte
 	b = make([]byte, 0, 8)
 	b = append(b, s.Version, s.Command)
-	b = append(b, s.Address[0:4]...)
 	b = append(b, byte((s.Port&0xFF00)>>8), byte(s.Port&0xFF))
+	if ip4 := s.Address.To4(); ip4 != nil {
+		b = append(b, ip4...)
+	} else {
+		b = append(b, 0, 0, 0, 0)
+	}
 
 	if _, err := w.Write(b); err != nil {
 		return fmt.Errorf("Error writing Socks4Reply: %v", err)
@@ -322,3 +513,18 @@ func (s *Socks4Reply) WriteBinary(w io.Writer) error {
 
 	return nil
 }
+
+// setAddress fills DSTPORT and DSTIP from a TCP address. IPv6 addresses
+// cannot be represented and are sent as 0, which tells the client to use
+// the address of the SOCKS server instead. Any other address, or nil, is
+// sent as 0.0.0.0:0.
+func (s *Socks4Reply) setAddress(addr net.Addr) {
+	s.Address = net.IPv4zero.To4()
+	s.Port = 0
+	if a, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := a.IP.To4(); ip4 != nil {
+			s.Address = ip4
+		}
+		s.Port = uint16(a.Port)
+	}
+}
@@ -1,12 +1,12 @@
-package main
+package gator
 
 import (
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"strconv"
 )
 
 /**
@@ -522,109 +522,170 @@ Leech, et al                Standards Track                     [Page 9]
 
 type Method5Request struct {
 	// version byte
-	methods []byte
+	Methods []byte
 }
 
 type Method5Reply struct {
-	version byte
-	method  byte
+	Version byte
+	Method  byte
 }
 
 type Socks5Request struct {
-	version     byte
-	command     byte
-	addressType byte
-	address     net.IP
-	domain      string
-	port        uint16
+	Version     byte
+	Command     byte
+	AddressType byte
+	Address     net.IP
+	Domain      string
+	Port        uint16
 }
 
 type Socks5Reply struct {
-	version     byte
-	reply       byte
-	addressType byte
-	address     net.IP
-	domain      string
-	port        uint16
+	Version     byte
+	Reply       byte
+	AddressType byte
+	Address     net.IP
+	Domain      string
+	Port        uint16
 }
 
+// Sock5 serves a SOCKS5 client whose version number has already been
+// read. The zero value serves it as a zero Server would.
 type Sock5 struct {
+	server *Server
+
+	// identity is who the client authenticated as.
+	identity *Identity
+}
+
+// NewSock5 returns a SOCKS5 handler with the settings of s.
+func NewSock5(s *Server) *Sock5 {
+	return &Sock5{server: s}
 }
 
 func (s *Sock5) Proxy(client net.Conn) error {
+	if s.server == nil {
+		s.server = new(Server)
+	}
+	hs := &handshakeReader{conn: client, timeout: s.server.HandshakeTimeout}
+
+	hs.stage(maxMethodRequest)
 	mr := new(Method5Request)
-	if err := mr.ReadBinary(client); err != nil {
+	if err := mr.ReadBinary(hs); err != nil {
 		return err
 	}
 
-	hasAnonAuth := false
+	// The server's order of preference decides between the methods the
+	// client offers.
+	auth := selectMethod(s.server.Authenticators, mr.Methods)
 
-	for _, method := range mr.methods {
-		if method == 0x00 {
-			hasAnonAuth = true
-		}
+	rep := new(Method5Reply)
+	rep.Version = 0x05
+	if auth != nil {
+		rep.Method = auth.Method()
+	} else {
+		rep.Method = 0xFF //No method available
 	}
+	rep.WriteBinary(client)
 
-	if hasAnonAuth {
-		rep := new(Method5Reply)
-		rep.version = 0x05
-		rep.method = 0x00 //No auth required
-		rep.WriteBinary(client)
-	} else {
-		rep := new(Method5Reply)
-		rep.version = 0x05
-		rep.method = 0xFF //No method available
-		rep.WriteBinary(client)
+	if auth == nil {
 		return errors.New("No method available")
 	}
 
+	hs.stage(maxAuthRequest)
+	identity, err := auth.Negotiate(hs)
+	if err != nil {
+		return err
+	}
+	s.identity = identity
+
+	hs.stage(maxSocks5Request)
 	sr := new(Socks5Request)
-	if err := sr.ReadBinary(client); err != nil {
+	if err := sr.ReadBinary(hs); err != nil {
+		// Requests the server does not support are still answered.
+		if errors.Is(err, ErrCommand) || errors.Is(err, ErrAddressType) {
+			srep := Socks5Reply{Version: 0x05, Reply: replyCode5(err)}
+			srep.setAddress(nil)
+			srep.WriteBinary(client)
+		}
 		return err
 	}
+	hs.done()
 
-	log.Printf("v5 cmd: %d, port: %d, ip: %d, domain: %s\n", sr.command, sr.port, sr.address, sr.domain)
+	s.server.logf("v5 cmd: %d, port: %d, ip: %s, domain: %s, user: %s\n", sr.Command, sr.Port, sr.Address, sr.Domain, s.identity)
+
+	req := &Request{
+		Command:  sr.Command,
+		Source:   client.RemoteAddr(),
+		Host:     sr.host(),
+		Port:     int(sr.Port),
+		Identity: s.identity,
+	}
+	// The address in a UDP ASSOCIATE is the client's own, not a
+	// destination that rules could match: the setup is checked without
+	// one, and every datagram against its own destination.
+	if sr.Command == CmdAssociate {
+		req.Host, req.Port = "", 0
+	}
+	if !s.server.allow(req) {
+		srep := Socks5Reply{
+			Version:     0x05,
+			Reply:       0x02, //Connection not allowed by ruleset
+			AddressType: sr.AddressType,
+			Address:     sr.Address,
+			Domain:      sr.Domain,
+			Port:        sr.Port,
+		}
+		srep.WriteBinary(client)
+		return errNotAllowed
+	}
+
+	if sr.Command == 2 {
+		return s.bind(client, sr)
+	}
+
+	if sr.Command == 3 {
+		return s.udpAssociate(client, sr)
+	}
 
 	// only connect command
-	if sr.command != 1 {
-		log.Printf("Unimplemented command: %d", sr.command)
+	if sr.Command != 1 {
+		s.server.logf("Unimplemented command: %d", sr.Command)
 		srep := new(Socks5Reply)
-		srep.version = 0x05
-		srep.reply = 0x07 //Command not supported
-		srep.addressType = sr.addressType
-		srep.address = sr.address
-		srep.port = sr.port
+		srep.Version = 0x05
+		srep.Reply = 0x07 //Command not supported
+		srep.setAddress(nil)
 		srep.WriteBinary(client)
 		return nil
 	}
 
 	//Let's try to connect to the target
-	address := ""
-	if sr.addressType == 3 {
-		address = fmt.Sprintf("%s:%d", sr.domain, sr.port)
-	} else if sr.addressType == 1 {
-		address = fmt.Sprintf("%s:%d", sr.address, sr.port)
-	} else if sr.addressType == 4 {
-		address = fmt.Sprintf("%s[:]%d", sr.address, sr.port)
-	} else {
-		return errors.New("Unknown address type in socks request struct")
-	}
+	address := net.JoinHostPort(sr.host(), strconv.Itoa(int(sr.Port)))
 
 	srep := Socks5Reply{
-		version:     0x05,
-		reply:       0x00, //General error
-		addressType: sr.addressType,
-		address:     sr.address,
-		port:        sr.port,
+		Version: 0x05,
 	}
 
-	server, err := net.Dial("tcp", address)
-	if err != nil {
-		srep.reply = 0x01 //General error
+	server, err := s.server.dial(client, s.identity, "tcp", address)
+	if err == errHungUp {
+		return err
+	}
+
+	// BND is the address of our end of the connection, the destination
+	// may well have been reached through another interface than the one
+	// the client knows.
+	srep.Reply = replyCode5(err)
+	if err == nil {
+		srep.setAddress(server.LocalAddr())
+		// Through an upstream, the remote address is the upstream's.
+		if sr.AddressType == 3 && s.server.Dialer == nil {
+			s.server.logf("v5 connect: %s resolved to %s\n", sr.Domain, server.RemoteAddr())
+		}
+	} else {
+		srep.setAddress(nil)
 	}
 	e := srep.WriteBinary(client)
 
-	if srep.reply == 0x01 {
+	if err != nil {
 		return fmt.Errorf("Dial: %s", err.Error())
 	}
 	defer server.Close()
@@ -632,26 +693,68 @@ func (s *Sock5) Proxy(client net.Conn) error {
 		return fmt.Errorf("respond: %s", e)
 	}
 
-	//Buffered so that the other goroutine doesn't deadlock
-	stopChan := make(chan bool, 1)
-	go func() {
-		io.Copy(client, server)
-		stopChan <- true
-	}()
-	go func() {
-		io.Copy(server, client)
-		stopChan <- true
-	}()
+	relay(client, server)
+	return nil
+}
+
+// bind waits for an inbound connection from the application server. Two
+// replies are sent: the first carries the address we listen on, the second
+// the address of the host that connected.
+func (s *Sock5) bind(client net.Conn, sr *Socks5Request) error {
+	srep := Socks5Reply{
+		Version:     0x05,
+		Reply:       0x00,
+		AddressType: sr.AddressType,
+		Address:     sr.Address,
+		Domain:      sr.Domain,
+		Port:        sr.Port,
+	}
+
+	ln, err := listenBind(client)
+	if err != nil {
+		srep.Reply = 0x01 //General error
+		srep.WriteBinary(client)
+		return fmt.Errorf("Listen: %s", err.Error())
+	}
+	defer ln.Close()
+
+	srep.setAddress(ln.Addr())
+	if err := srep.WriteBinary(client); err != nil {
+		return fmt.Errorf("respond: %s", err)
+	}
+
+	s.server.logf("v5 bind: waiting on %s\n", ln.Addr())
 
-	//Wait for either of the copies to stop
-	<-stopChan
+	server, err := acceptBind(client, ln, s.server.BindTimeout)
+	if err == errHungUp {
+		return err
+	}
+	if err != nil {
+		srep.Reply = replyCode5(err)
+		srep.WriteBinary(client)
+		return fmt.Errorf("Accept: %s", err.Error())
+	}
+	defer server.Close()
+
+	srep.setAddress(server.RemoteAddr())
+	if !bindPeerAllowed(server.RemoteAddr(), sr.Address, sr.Domain, s.server.Resolver) {
+		srep.Reply = 0x02 //Connection not allowed by ruleset
+		srep.WriteBinary(client)
+		return fmt.Errorf("bind: unexpected peer %s", server.RemoteAddr())
+	}
+
+	if err := srep.WriteBinary(client); err != nil {
+		return fmt.Errorf("respond: %s", err)
+	}
+
+	relay(client, server)
 	return nil
 }
 
 func (s *Method5Request) ReadBinary(r io.Reader) error {
 	b := make([]byte, 1)
-	if n, _ := r.Read(b); n != 1 {
-		return errors.New("Method5Request packet is too short")
+	if err := readFull(r, b, "Method5Request"); err != nil {
+		return err
 	}
 
 	// if s.version = b[0]; s.version != 0x04 || s.version != 0x05 {
@@ -661,19 +764,47 @@ func (s *Method5Request) ReadBinary(r io.Reader) error {
 	numMethods := int(b[0])
 
 	if numMethods == 0 {
-		return errors.New("Invalid number of methods: 0")
+		return &ProtocolError{Message: "Method5Request", Err: fmt.Errorf("%w: no methods", ErrMalformed)}
 	} else {
-		s.methods = make([]byte, numMethods)
+		s.Methods = make([]byte, numMethods)
 	}
 
-	if n, _ := r.Read(s.methods); n != numMethods {
-		return errors.New("Method5Request packet is too short")
+	return readFull(r, s.Methods, "Method5Request")
+}
+
+// WriteBinary writes the whole message, including the version number that
+// ReadBinary expects to have been read already.
+func (s *Method5Request) WriteBinary(w io.Writer) error {
+	if len(s.Methods) == 0 || len(s.Methods) > 255 {
+		return fmt.Errorf("Cannot write Method5Request, Invalid number of methods: %d", len(s.Methods))
+	}
+
+	b := make([]byte, 0, 2+len(s.Methods))
+	b = append(b, 0x05, byte(len(s.Methods)))
+	b = append(b, s.Methods...)
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("Error writing Method5Request: %v", err)
 	}
+
+	return nil
+}
+
+func (s *Method5Reply) ReadBinary(r io.Reader) error {
+	b := make([]byte, 2)
+	if err := readFull(r, b, "Method5Reply"); err != nil {
+		return err
+	}
+
+	if s.Version = b[0]; s.Version != 0x05 {
+		return &ProtocolError{Message: "Method5Reply", Err: fmt.Errorf("%w %d", ErrVersion, b[0])}
+	}
+	s.Method = b[1]
+
 	return nil
 }
 
 func (s *Method5Reply) WriteBinary(w io.Writer) error {
-	out := []byte{s.version, s.method}
+	out := []byte{s.Version, s.Method}
 	if _, err := w.Write(out); err != nil {
 		return fmt.Errorf("Error writing Method5Reply: %v", err)
 	}
@@ -684,89 +815,99 @@ func (s *Method5Reply) WriteBinary(w io.Writer) error {
 func (s *Socks5Request) ReadBinary(r io.Reader) error {
 	b := make([]byte, 4)
 
-	if n, _ := r.Read(b); n != 4 {
-		return errors.New("Socks5Request input too short")
+	if err := readFull(r, b, "Socks5Request"); err != nil {
+		return err
 	}
 
-	if s.version = b[0]; s.version != 0x05 {
-		return fmt.Errorf("Invalid version: %d", b[0])
+	if s.Version = b[0]; s.Version != 0x05 {
+		return &ProtocolError{Message: "Socks5Request", Err: fmt.Errorf("%w %d", ErrVersion, b[0])}
 	}
 
-	if s.command = b[1]; b[1] == 0 || b[1] > 3 {
-		return fmt.Errorf("Invalid command: %d", s.command)
+	if s.Command = b[1]; b[1] == 0 || b[1] > 3 {
+		return &ProtocolError{Message: "Socks5Request", Err: fmt.Errorf("%w %d", ErrCommand, s.Command)}
 	}
 
-	if s.addressType = b[3]; b[3] != 1 && b[3] != 3 && b[3] != 4 {
-		return fmt.Errorf("Invalid address type: %d", b[3])
+	s.AddressType = b[3]
+	address, domain, err := readAddress(r, s.AddressType, "Socks5Request")
+	if err != nil {
+		return err
 	}
 
-	if s.addressType == 1 {
-		address := make([]byte, 4)
-		if n, _ := r.Read(address); n != 4 {
-			return errors.New("Socks5Request address is too short")
-		}
+	s.Address = address
+	s.Domain = domain
 
-		s.address = address
+	// portBytes := make([]byte, 2)
+	// if n, _ := r.Read(portBytes); n != 2 {
+	// 	return errors.New("Socks5Request missing port")
+	// }
 
-	} else if s.addressType == 4 {
-		address := make([]byte, 16)
-		if n, _ := r.Read(address); n != 16 {
-			return errors.New("Socks5Request address is too short")
-		}
+	// //Horrible, but it works
+	// s.port = (int(portBytes[0]) << 8) + int(portBytes[1])
 
-		s.address = address
+	if err := readFull(r, b[:2], "Socks5Request"); err != nil {
+		return err
+	}
+	s.Port = binary.BigEndian.Uint16(b)
 
-	} else if s.addressType == 3 {
-		length := make([]byte, 1)
+	return nil
+}
 
-		if n, _ := r.Read(length); n != 1 {
-			return errors.New("Socks5Request domain length missing")
-		}
+func (s *Socks5Request) WriteBinary(w io.Writer) error {
+	b := make([]byte, 0, 22)
+	b = append(b, s.Version, s.Command, 0x00, s.AddressType)
+	b, err := appendAddress(b, s.AddressType, s.Address, s.Domain, s.Port)
+	if err != nil {
+		return fmt.Errorf("Cannot write Socks5Request, %s", err)
+	}
 
-		domainLength := int(length[0])
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("Error writing Socks5Request: %v", err)
+	}
 
-		domain := make([]byte, domainLength)
-		if n, _ := r.Read(domain); n < domainLength {
-			return errors.New("Socks5Request domain too short")
-		}
+	return nil
+}
 
-		s.domain = string(domain)
+// host returns DST.ADDR as a domain name or IP address.
+func (s *Socks5Request) host() string {
+	if s.AddressType == 3 {
+		return s.Domain
 	}
+	return s.Address.String()
+}
 
-	// portBytes := make([]byte, 2)
-	// if n, _ := r.Read(portBytes); n != 2 {
-	// 	return errors.New("Socks5Request missing port")
-	// }
+func (s *Socks5Reply) ReadBinary(r io.Reader) error {
+	b := make([]byte, 4)
+	if err := readFull(r, b, "Socks5Reply"); err != nil {
+		return err
+	}
 
-	// //Horrible, but it works
-	// s.port = (int(portBytes[0]) << 8) + int(portBytes[1])
+	if s.Version = b[0]; s.Version != 0x05 {
+		return &ProtocolError{Message: "Socks5Reply", Err: fmt.Errorf("%w %d", ErrVersion, b[0])}
+	}
+	s.Reply = b[1]
+	s.AddressType = b[3]
 
-	if err := binary.Read(r, binary.BigEndian, &s.port); err != nil {
+	address, domain, err := readAddress(r, s.AddressType, "Socks5Reply")
+	if err != nil {
 		return err
 	}
+	s.Address = address
+	s.Domain = domain
+
+	if err := readFull(r, b[:2], "Socks5Reply"); err != nil {
+		return err
+	}
+	s.Port = binary.BigEndian.Uint16(b)
 
 	return nil
 }
 
 func (s *Socks5Reply) WriteBinary(w io.Writer) error {
-	var b []byte
-	if s.addressType == 0 || s.addressType == 1 {
-		b = make([]byte, 0, 10)
-		b = append(b, s.version, s.reply, 0x00, s.addressType)
-		b = append(b, s.address[0:4]...)
-		b = append(b, byte((s.port&0xFF00)>>8), byte(s.port&0xFF))
-	} else if s.addressType == 4 {
-		b = make([]byte, 0, 22)
-		b = append(b, s.version, s.reply, 0x00, s.addressType)
-		b = append(b, s.address[0:16]...)
-		b = append(b, byte((s.port&0xFF00)>>8), byte(s.port&0xFF))
-	} else if s.addressType == 3 {
-		b = make([]byte, 0, 7+len(s.domain))
-		b = append(b, s.version, s.reply, 0x00, s.addressType, byte(len(s.domain)))
-		b = append(b, s.domain...)
-		b = append(b, byte((s.port&0xFF00)>>8), byte(s.port&0xFF))
-	} else {
-		return errors.New("Cannot write Socks5Reply, Invalid address type")
+	b := make([]byte, 0, 22)
+	b = append(b, s.Version, s.Reply, 0x00, s.AddressType)
+	b, err := appendAddress(b, s.AddressType, s.Address, s.Domain, s.Port)
+	if err != nil {
+		return fmt.Errorf("Cannot write Socks5Reply, %s", err)
 	}
 
 	if _, err := w.Write(b); err != nil {
@@ -775,3 +916,91 @@ func (s *Socks5Reply) WriteBinary(w io.Writer) error {
 
 	return nil
 }
+
+// setAddress fills the address fields from a TCP or UDP address. Any other
+// address, or nil, is reported as 0.0.0.0:0.
+func (s *Socks5Reply) setAddress(addr net.Addr) {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		s.AddressType, s.Address = 1, ip4
+	} else if ip != nil {
+		s.AddressType, s.Address = 4, ip.To16()
+	} else {
+		s.AddressType, s.Address = 1, net.IPv4zero.To4()
+	}
+	s.Domain = ""
+	s.Port = uint16(port)
+}
+
+// readAddress reads a DST.ADDR field of the given ATYP from r, as part of
+// message. IPv4 and IPv6 addresses are returned as an IP, a DOMAINNAME as a
+// string.
+func readAddress(r io.Reader, addressType byte, message string) (net.IP, string, error) {
+	switch addressType {
+	case 1:
+		address := make([]byte, 4)
+		if err := readFull(r, address, message); err != nil {
+			return nil, "", err
+		}
+		return address, "", nil
+	case 4:
+		address := make([]byte, 16)
+		if err := readFull(r, address, message); err != nil {
+			return nil, "", err
+		}
+		return address, "", nil
+	case 3:
+		length := make([]byte, 1)
+		if err := readFull(r, length, message); err != nil {
+			return nil, "", err
+		}
+		if length[0] == 0 {
+			return nil, "", &ProtocolError{Message: message, Err: fmt.Errorf("%w: empty domain", ErrMalformed)}
+		}
+
+		domain := make([]byte, int(length[0]))
+		if err := readFull(r, domain, message); err != nil {
+			return nil, "", err
+		}
+		return nil, string(domain), nil
+	}
+	return nil, "", &ProtocolError{Message: message, Err: fmt.Errorf("%w %d", ErrAddressType, addressType)}
+}
+
+// appendAddress appends an ATYP-specific address field followed by the port
+// in network octet order to b.
+func appendAddress(b []byte, addressType byte, address net.IP, domain string, port uint16) ([]byte, error) {
+	switch addressType {
+	case 0, 1:
+		ip4 := address.To4()
+		if ip4 == nil {
+			return nil, fmt.Errorf("Invalid IPv4 address: %s", address)
+		}
+		b = append(b, ip4...)
+	case 4:
+		if len(address) != net.IPv6len {
+			return nil, fmt.Errorf("Invalid IPv6 address: %s", address)
+		}
+		b = append(b, address...)
+	case 3:
+		if len(domain) == 0 {
+			return nil, fmt.Errorf("Empty domain")
+		}
+		if len(domain) > 255 {
+			return nil, fmt.Errorf("Domain too long: %d bytes", len(domain))
+		}
+		b = append(b, byte(len(domain)))
+		b = append(b, domain...)
+	default:
+		return nil, fmt.Errorf("Invalid address type: %d", addressType)
+	}
+	return append(b, byte((port&0xFF00)>>8), byte(port&0xFF)), nil
+}
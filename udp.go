@@ -0,0 +1,372 @@
+package gator
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// udpLookupTimeout limits how long the domain name of a datagram may take
+// to resolve, and maxUDPLookups how many may be resolving at once in an
+// association. Datagrams beyond that are dropped.
+const (
+	udpLookupTimeout = 5 * time.Second
+	maxUDPLookups    = 16
+)
+
+// Socks5UDPRequest is the header carried by every datagram relayed through
+// a UDP association, see "Procedure for UDP-based clients" in sock5.go.
+//
+//	+----+------+------+----------+----------+----------+
+//	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+----+------+------+----------+----------+----------+
+//	| 2  |  1   |  1   | Variable |    2     | Variable |
+//	+----+------+------+----------+----------+----------+
+type Socks5UDPRequest struct {
+	Frag        byte
+	AddressType byte
+	Address     net.IP
+	Domain      string
+	Port        uint16
+	Data        []byte
+}
+
+// udpAssociation relays datagrams between one client and any number of
+// remote hosts, over a single UDP socket unless the client has an Egress.
+type udpAssociation struct {
+	server *Server
+	conn   *net.UDPConn
+
+	// remote is the socket that datagrams to remote hosts leave from and
+	// their replies arrive on: conn, or a socket of its own bound to the
+	// Egress of the client. family is what remote can reach.
+	remote *net.UDPConn
+	family AddressFamily
+
+	// source and identity are those of the client's TCP connection, for
+	// checking every datagram against the rules.
+	source   net.Addr
+	identity *Identity
+
+	// clientIP is the only source address datagrams are accepted from.
+	// clientPort is 0 until the first datagram arrives when the client did
+	// not declare one in its UDP ASSOCIATE request. Replies read from
+	// remote by a goroutine of its own need mu to read it.
+	clientIP   net.IP
+	mu         sync.Mutex
+	clientPort int
+
+	// lookups holds a token for every domain name being resolved, off the
+	// loop that reads the client's datagrams. ctx ends them when the
+	// association terminates.
+	lookups chan struct{}
+	ctx     context.Context
+}
+
+func (s *Sock5) udpAssociate(client net.Conn, sr *Socks5Request) error {
+	srep := Socks5Reply{
+		Version:     0x05,
+		Reply:       0x00,
+		AddressType: sr.AddressType,
+		Address:     sr.Address,
+		Domain:      sr.Domain,
+		Port:        sr.Port,
+	}
+
+	// The relay listens on all addresses of both families, so that it can
+	// reach IPv4 and IPv6 destinations alike. The BND.ADDR we report is
+	// the address the client reached us on, which it can send to.
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		srep.Reply = 0x01 //General error
+		srep.WriteBinary(client)
+		return fmt.Errorf("ListenUDP: %s", err.Error())
+	}
+	defer conn.Close()
+
+	// Datagrams to remote hosts leave from the Egress of the client, the
+	// relay socket cannot: the client must be able to reach it.
+	egress := s.server.egress(s.identity)
+	remote := conn
+	if !egress.isZero() {
+		if remote, err = egress.listenUDP(); err != nil {
+			srep.Reply = 0x01 //General error
+			srep.WriteBinary(client)
+			return fmt.Errorf("ListenUDP: %s", err.Error())
+		}
+		defer remote.Close()
+	}
+
+	bnd := &net.UDPAddr{IP: connIP(client.LocalAddr()), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	srep.setAddress(bnd)
+
+	if err := srep.WriteBinary(client); err != nil {
+		return fmt.Errorf("respond: %s", err)
+	}
+
+	// The client may send all zeros if it does not yet know the address it
+	// will send from, in which case the source of the TCP connection is
+	// the best guess.
+	a := &udpAssociation{
+		server:     s.server,
+		conn:       conn,
+		remote:     remote,
+		family:     egress.family(s.server.Family),
+		source:     client.RemoteAddr(),
+		identity:   s.identity,
+		clientPort: int(sr.Port),
+	}
+	if sr.AddressType != 3 && !sr.Address.IsUnspecified() {
+		a.clientIP = sr.Address
+	} else {
+		a.clientIP = connIP(client.RemoteAddr())
+	}
+
+	var cancel context.CancelFunc
+	a.ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	a.lookups = make(chan struct{}, maxUDPLookups)
+
+	s.server.logf("v5 udp associate: relay %s for %s\n", bnd, a.clientIP)
+
+	// A UDP association terminates when the TCP connection that the UDP
+	// ASSOCIATE request arrived on terminates.
+	go func() {
+		io.Copy(io.Discard, client)
+		conn.Close()
+		remote.Close()
+	}()
+
+	a.serve()
+	return nil
+}
+
+// connIP returns the IP address of an end of a client connection. Clients
+// of a Unix socket are on the same host, they use the loopback address.
+func connIP(addr net.Addr) net.IP {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return net.IPv4(127, 0, 0, 1)
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	return net.ParseIP(host)
+}
+
+// serve relays datagrams until the sockets are closed.
+func (a *udpAssociation) serve() {
+	if a.remote != a.conn {
+		go a.serveRemote()
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if a.fromClient(from) {
+			if err := a.forward(buf[:n]); err != nil {
+				a.server.logf("udp relay: %s", err)
+			}
+			continue
+		}
+
+		// A reply from a remote host, unless they have a socket of their
+		// own.
+		if a.remote != a.conn {
+			continue
+		}
+		if err := a.reply(from, buf[:n]); err != nil {
+			a.server.logf("udp relay: %s", err)
+		}
+	}
+}
+
+// serveRemote relays the replies that arrive on a socket of their own
+// until it is closed.
+func (a *udpAssociation) serveRemote() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := a.remote.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if err := a.reply(from, buf[:n]); err != nil {
+			a.server.logf("udp relay: %s", err)
+		}
+	}
+}
+
+// fromClient reports whether a datagram from addr belongs to the client,
+// pinning the client's port on the first datagram if it was not declared.
+func (a *udpAssociation) fromClient(addr *net.UDPAddr) bool {
+	if !addr.IP.Equal(a.clientIP) {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.clientPort == 0 {
+		a.clientPort = addr.Port
+	}
+	return addr.Port == a.clientPort
+}
+
+// forward unwraps a client datagram and sends its data to DST.ADDR.
+func (a *udpAssociation) forward(packet []byte) error {
+	ur := new(Socks5UDPRequest)
+	if err := ur.ReadBinary(bytes.NewReader(packet)); err != nil {
+		return err
+	}
+
+	// Fragmentation is not implemented, such datagrams MUST be dropped.
+	if ur.Frag != 0 {
+		return fmt.Errorf("dropped fragment %d", ur.Frag)
+	}
+
+	host := ur.Domain
+	if ur.AddressType != 3 {
+		host = ur.Address.String()
+	}
+
+	req := &Request{
+		Command:  CmdAssociate,
+		Source:   a.source,
+		Host:     host,
+		Port:     int(ur.Port),
+		Identity: a.identity,
+	}
+	if !a.server.allow(req) {
+		return fmt.Errorf("dropped datagram to %s: %w", net.JoinHostPort(host, strconv.Itoa(int(ur.Port))), errNotAllowed)
+	}
+
+	if ur.AddressType != 3 {
+		if !a.family.allows(ur.Address) {
+			return fmt.Errorf("dropped datagram to %s: not %s", ur.Address, a.family)
+		}
+		return a.send(ur.Address, ur)
+	}
+
+	// A slow name server must not hold up the other datagrams.
+	select {
+	case a.lookups <- struct{}{}:
+	default:
+		return fmt.Errorf("dropped datagram to %s: too many lookups in progress", host)
+	}
+	go func() {
+		defer func() { <-a.lookups }()
+		if err := a.resolve(ur); err != nil {
+			a.server.logf("udp relay: %s", err)
+		}
+	}()
+	return nil
+}
+
+// resolve sends the data of ur to an address of its domain name.
+func (a *udpAssociation) resolve(ur *Socks5UDPRequest) error {
+	ctx, cancel := context.WithTimeout(a.ctx, udpLookupTimeout)
+	defer cancel()
+
+	ips, err := lookupIP(ctx, a.server.Resolver, "ip", ur.Domain)
+	if err != nil {
+		return err
+	}
+	if ips = a.family.order(ips); len(ips) == 0 {
+		return fmt.Errorf("dropped datagram to %s: no %s address", ur.Domain, a.family)
+	}
+	return a.send(ips[0], ur)
+}
+
+// send sends the data of ur to ip, at its DST.PORT.
+func (a *udpAssociation) send(ip net.IP, ur *Socks5UDPRequest) error {
+	dst := &net.UDPAddr{IP: ip, Port: int(ur.Port)}
+	if err := a.server.guard().Check(dst.IP); err != nil {
+		return fmt.Errorf("dropped datagram to %s: %w", dst, err)
+	}
+
+	_, err := a.remote.WriteToUDP(ur.Data, dst)
+	return err
+}
+
+// reply wraps a datagram received from a remote host and sends it to the
+// client. It can only be delivered once the client's port is known.
+func (a *udpAssociation) reply(from *net.UDPAddr, data []byte) error {
+	a.mu.Lock()
+	port := a.clientPort
+	a.mu.Unlock()
+	if port == 0 {
+		return nil
+	}
+
+	ur := Socks5UDPRequest{
+		AddressType: 1,
+		Address:     from.IP.To4(),
+		Port:        uint16(from.Port),
+		Data:        data,
+	}
+	if ur.Address == nil {
+		ur.AddressType, ur.Address = 4, from.IP.To16()
+	}
+
+	var b bytes.Buffer
+	if err := ur.WriteBinary(&b); err != nil {
+		return err
+	}
+
+	_, err := a.conn.WriteToUDP(b.Bytes(), &net.UDPAddr{IP: a.clientIP, Port: port})
+	return err
+}
+
+func (s *Socks5UDPRequest) ReadBinary(r io.Reader) error {
+	b := make([]byte, 4)
+
+	if err := readFull(r, b, "Socks5UDPRequest"); err != nil {
+		return err
+	}
+
+	if b[0] != 0 || b[1] != 0 {
+		return &ProtocolError{Message: "Socks5UDPRequest", Err: fmt.Errorf("%w: reserved field is not zero", ErrMalformed)}
+	}
+
+	s.Frag = b[2]
+	s.AddressType = b[3]
+
+	address, domain, err := readAddress(r, s.AddressType, "Socks5UDPRequest")
+	if err != nil {
+		return err
+	}
+
+	s.Address = address
+	s.Domain = domain
+
+	if err := readFull(r, b[:2], "Socks5UDPRequest"); err != nil {
+		return err
+	}
+	s.Port = binary.BigEndian.Uint16(b)
+
+	s.Data, err = io.ReadAll(r)
+	return err
+}
+
+// WriteBinary writes the header and the data in a single call, so that w
+// sees one whole datagram.
+func (s *Socks5UDPRequest) WriteBinary(w io.Writer) error {
+	b := make([]byte, 0, 22+len(s.Data))
+	b = append(b, 0x00, 0x00, s.Frag, s.AddressType)
+	b, err := appendAddress(b, s.AddressType, s.Address, s.Domain, s.Port)
+	if err != nil {
+		return fmt.Errorf("Cannot write Socks5UDPRequest, %s", err)
+	}
+	b = append(b, s.Data...)
+
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("Error writing Socks5UDPRequest: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package gator
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPEcho runs a UDP server on the IPv4 loopback address that sends
+// every datagram back to where it came from.
+func startUDPEcho(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("udp loopback unavailable: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(b[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// udpClient is a SOCKS5 client with a UDP association.
+type udpClient struct {
+	t     *testing.T
+	ctrl  net.Conn
+	conn  *net.UDPConn
+	relay *net.UDPAddr
+}
+
+// associate sets up a UDP association with the proxy at addr. The client
+// declares the port of its UDP socket if declare is set, and all zeros
+// otherwise.
+func associate(t *testing.T, addr net.Addr, declare bool) *udpClient {
+	t.Helper()
+	c := &udpClient{t: t}
+	var err error
+	if c.conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.conn.Close() })
+	if c.ctrl, err = net.DialTimeout("tcp", addr.String(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.ctrl.Close() })
+	c.ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+
+	ip, port := net.IPv4zero, 0
+	if declare {
+		ip, port = net.IPv4(127, 0, 0, 1), c.conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	rep, err := socks5Command(c.ctrl, CmdAssociate, ip, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Reply != 0x00 {
+		t.Fatalf("reply %#02x, want success", rep.Reply)
+	}
+	c.relay = &net.UDPAddr{IP: rep.Address, Port: int(rep.Port)}
+	return c
+}
+
+// send sends data to dst through the relay, from the client's socket.
+func (c *udpClient) send(frag byte, dst *net.UDPAddr, data string) {
+	c.t.Helper()
+	sendUDP(c.t, c.conn, c.relay, frag, dst, data)
+}
+
+// sendUDP wraps data to dst in a SOCKS5 UDP header and sends it from conn.
+func sendUDP(t *testing.T, conn *net.UDPConn, relay *net.UDPAddr, frag byte, dst *net.UDPAddr, data string) {
+	t.Helper()
+	ur := &Socks5UDPRequest{Frag: frag, AddressType: 0x01, Address: dst.IP.To4(), Port: uint16(dst.Port), Data: []byte(data)}
+	if ur.Address == nil {
+		ur.AddressType, ur.Address = 0x04, dst.IP
+	}
+	var b bytes.Buffer
+	if err := ur.WriteBinary(&b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteToUDP(b.Bytes(), relay); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive returns the next datagram the relay delivers within wait, nil if
+// none does.
+func (c *udpClient) receive(wait time.Duration) *Socks5UDPRequest {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(wait))
+	b := make([]byte, 65535)
+	n, _, err := c.conn.ReadFromUDP(b)
+	if err != nil {
+		if !isTimeout(err) {
+			c.t.Fatal(err)
+		}
+		return nil
+	}
+	ur := new(Socks5UDPRequest)
+	if err := ur.ReadBinary(bytes.NewReader(b[:n])); err != nil {
+		c.t.Fatal(err)
+	}
+	return ur
+}
+
+// expect checks that the next datagram delivered is data from src.
+func (c *udpClient) expect(src *net.UDPAddr, data string) {
+	c.t.Helper()
+	ur := c.receive(time.Second)
+	if ur == nil {
+		c.t.Fatalf("no datagram, want %q from %s", data, src)
+	}
+	if !ur.Address.Equal(src.IP) || int(ur.Port) != src.Port || string(ur.Data) != data {
+		c.t.Fatalf("got %q from %s:%d, want %q from %s", ur.Data, ur.Address, ur.Port, data, src)
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := startUDPEcho(t)
+	proxy := startServer(t, "tcp4")
+
+	c := associate(t, proxy, true)
+	c.send(0, echo, "one")
+	c.expect(echo, "one")
+
+	// Fragments are dropped.
+	c.send(1, echo, "fragment")
+	c.send(0, echo, "two")
+	c.expect(echo, "two")
+
+	// Datagrams from another port of the client are not the client's:
+	// they are not forwarded, but delivered to the client as from a
+	// remote host.
+	stranger, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	sendUDP(t, stranger, c.relay, 0, echo, "spoofed")
+	ur := c.receive(time.Second)
+	if ur == nil || int(ur.Port) != stranger.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("got %+v, want the datagram of the other port", ur)
+	}
+	if ur := c.receive(200 * time.Millisecond); ur != nil {
+		t.Fatalf("the datagram of the other port was forwarded: %+v", ur)
+	}
+
+	// The association ends with its TCP connection.
+	c.ctrl.Close()
+	time.Sleep(100 * time.Millisecond)
+	c.send(0, echo, "after close")
+	if ur := c.receive(200 * time.Millisecond); ur != nil {
+		t.Fatalf("relayed after the TCP connection closed: %+v", ur)
+	}
+}
+
+// TestUDPAssociatePinsPort checks that a client that does not declare its
+// port gets it pinned by its first datagram.
+func TestUDPAssociatePinsPort(t *testing.T) {
+	echo := startUDPEcho(t)
+	proxy := startServer(t, "tcp4")
+
+	c := associate(t, proxy, false)
+	c.send(0, echo, "first")
+	c.expect(echo, "first")
+
+	other, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	sendUDP(t, other, c.relay, 0, echo, "second")
+	other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := other.ReadFromUDP(make([]byte, 512)); err == nil {
+		t.Fatalf("relayed %d bytes to a port other than the pinned one", n)
+	}
+	if ur := c.receive(time.Second); ur == nil || int(ur.Port) != other.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("got %+v, want the datagram of the other port", ur)
+	}
+}
+
+// TestUDPAssociateEgress sends the datagrams of a client with an Egress
+// from it, and relays the replies back to the client.
+func TestUDPAssociateEgress(t *testing.T) {
+	egress := loopbackAlias(t, "127.0.0.2")
+
+	// A server that answers with the address datagrams come from.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			_, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP([]byte(addr.IP.String()), addr)
+		}
+	}()
+	dst := conn.LocalAddr().(*net.UDPAddr)
+
+	proxy := serve(t, "tcp4", &Server{Authenticators: []Authenticator{NoAuth{}}, Guard: allowLoopback, Egress: egress})
+	c := associate(t, proxy, true)
+	c.send(0, dst, "from?")
+	c.expect(dst, "127.0.0.2")
+
+	// IPv6 destinations cannot be reached from an IPv4 source.
+	c.send(0, &net.UDPAddr{IP: net.IPv6loopback, Port: dst.Port}, "v6")
+	if ur := c.receive(200 * time.Millisecond); ur != nil {
+		t.Fatalf("relayed to IPv6 from an IPv4 source: %+v", ur)
+	}
+}
+
+// stallResolver resolves fast.test to the IPv4 loopback address, and never
+// answers for other names.
+type stallResolver struct{}
+
+func (stallResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if host == "fast.test" {
+		return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// TestUDPAssociateSlowLookup checks that a datagram to a domain name that
+// does not resolve holds up neither the other datagrams nor the replies.
+func TestUDPAssociateSlowLookup(t *testing.T) {
+	echo := startUDPEcho(t)
+	proxy := serve(t, "tcp4", &Server{Authenticators: []Authenticator{NoAuth{}}, Guard: allowLoopback, Resolver: stallResolver{}})
+	c := associate(t, proxy, true)
+
+	sendDomain := func(host, data string) {
+		ur := &Socks5UDPRequest{AddressType: 0x03, Domain: host, Port: uint16(echo.Port), Data: []byte(data)}
+		var b bytes.Buffer
+		if err := ur.WriteBinary(&b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.conn.WriteToUDP(b.Bytes(), c.relay); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sendDomain("slow.test", "stalled")
+	c.send(0, echo, "address")
+	c.expect(echo, "address")
+	sendDomain("fast.test", "name")
+	c.expect(echo, "name")
+}
@@ -0,0 +1,229 @@
+package gator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startUpstream runs a proxy that records the addresses it dials, see
+// pipeDialer, and denies port 25.
+func startUpstream(t *testing.T, authenticators ...Authenticator) (net.Addr, *pipeDialer) {
+	t.Helper()
+	dialer := new(pipeDialer)
+	addr := serve(t, "tcp4", &Server{
+		Dialer:         dialer,
+		Authenticators: authenticators,
+		Rules:          denyPort(25),
+		Logger:         log.New(io.Discard, "", 0),
+	})
+	return addr, dialer
+}
+
+func TestUpstreamDialers(t *testing.T) {
+	alice := &UserPassAuth{Credentials: StaticCredentials{"alice": "secret"}}
+	anonymous, anonymousDialed := startUpstream(t, NoAuth{})
+	password, passwordDialed := startUpstream(t, alice)
+
+	tests := []struct {
+		name   string
+		dialer Dialer
+		dialed *pipeDialer
+	}{
+		{"socks5", &SOCKS5Dialer{Addr: anonymous.String()}, anonymousDialed},
+		{"socks5 password", &SOCKS5Dialer{Addr: password.String(), Username: "alice", Password: "secret"}, passwordDialed},
+		{"socks4a", &SOCKS4Dialer{Addr: anonymous.String()}, anonymousDialed},
+		{"http", &HTTPDialer{Addr: anonymous.String()}, anonymousDialed},
+		{"http password", &HTTPDialer{Addr: password.String(), Username: "alice", Password: "secret"}, passwordDialed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.dialed.mu.Lock()
+			tt.dialed.dialed = nil
+			tt.dialed.mu.Unlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			for _, address := range []string{"example.com:80", "192.0.2.1:443"} {
+				conn, err := tt.dialer.DialContext(ctx, "tcp", address)
+				if err != nil {
+					t.Fatalf("%s: %s", address, err)
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				if _, err := conn.Write([]byte("ping")); err != nil {
+					t.Fatal(err)
+				}
+				b := make([]byte, 4)
+				if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+					t.Fatalf("%s: read %q, %v", address, b, err)
+				}
+				conn.Close()
+			}
+
+			// Domain names reach the upstream unresolved.
+			tt.dialed.mu.Lock()
+			if want := []string{"example.com:80", "192.0.2.1:443"}; !reflect.DeepEqual(tt.dialed.dialed, want) {
+				t.Errorf("upstream dialed %q, want %q", tt.dialed.dialed, want)
+			}
+			tt.dialed.mu.Unlock()
+
+			// The reason of a failure is passed back.
+			for address, want := range map[string]byte{"example.com:1": 0x05, "example.com:25": 0x02} {
+				_, err := tt.dialer.DialContext(ctx, "tcp", address)
+				var upErr *UpstreamError
+				if !errors.As(err, &upErr) {
+					t.Fatalf("%s: got %v, want an UpstreamError", address, err)
+				}
+				// SOCKS4 has no reasons, HTTP no reason for a refused
+				// connection.
+				if _, ok := tt.dialer.(*SOCKS4Dialer); ok {
+					want = 0x01
+				} else if _, ok := tt.dialer.(*HTTPDialer); ok && want == 0x05 {
+					want = 0x01
+				}
+				if got := replyCode5(err); got != want {
+					t.Errorf("%s: reply %#02x for %v, want %#02x", address, got, err, want)
+				}
+			}
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, d := range []Dialer{
+		&SOCKS5Dialer{Addr: password.String(), Username: "alice", Password: "wrong"},
+		&SOCKS5Dialer{Addr: password.String()},
+		&HTTPDialer{Addr: password.String(), Username: "alice", Password: "wrong"},
+	} {
+		if conn, err := d.DialContext(ctx, "tcp", "example.com:80"); err == nil {
+			conn.Close()
+			t.Errorf("%+v: connected with wrong credentials", d)
+		}
+	}
+}
+
+// TestChain serves clients through an upstream, with a domain name that
+// only the upstream can resolve.
+func TestChain(t *testing.T) {
+	upstream, dialed := startUpstream(t, NoAuth{})
+	proxy := serve(t, "tcp4", &Server{
+		Dialer:         &SOCKS5Dialer{Addr: upstream.String()},
+		Authenticators: []Authenticator{NoAuth{}},
+		Logger:         log.New(io.Discard, "", 0),
+	})
+
+	conn, err := net.Dial("tcp", proxy.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := &Socks4Request{Command: CmdConnect, Domain: "only.upstream.invalid", Port: 80}
+	if err := req.WriteBinary(conn); err != nil {
+		t.Fatal(err)
+	}
+	rep := new(Socks4Reply)
+	if err := rep.ReadBinary(conn); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Command != 90 {
+		t.Fatalf("reply %d", rep.Command)
+	}
+	checkEcho(t, conn)
+
+	dialed.mu.Lock()
+	defer dialed.mu.Unlock()
+	if want := []string{"only.upstream.invalid:80"}; !reflect.DeepEqual(dialed.dialed, want) {
+		t.Errorf("upstream dialed %q, want %q", dialed.dialed, want)
+	}
+}
+
+// TestSOCKS4Resolve resolves names for a SOCKS4 upstream with the Resolver
+// of the dialer.
+func TestSOCKS4Resolve(t *testing.T) {
+	upstream, dialed := startUpstream(t, NoAuth{})
+	d := &SOCKS4Dialer{
+		Addr:    upstream.String(),
+		Resolve: true,
+		Resolver: &HostsResolver{Hosts: map[string][]net.IP{
+			"v4.test": {net.ParseIP("192.0.2.7")},
+			"v6.test": {net.ParseIP("2001:db8::7")},
+		}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := d.DialContext(ctx, "tcp", "v4.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	dialed.mu.Lock()
+	if want := []string{"192.0.2.7:80"}; !reflect.DeepEqual(dialed.dialed, want) {
+		t.Errorf("upstream dialed %q, want %q", dialed.dialed, want)
+	}
+	dialed.mu.Unlock()
+
+	// A name without IPv4 addresses is not found.
+	_, err = d.DialContext(ctx, "tcp", "v6.test:80")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Errorf("dial of an IPv6 only name = %v, want not found", err)
+	}
+}
+
+func TestUpstreamCancel(t *testing.T) {
+	// An upstream that accepts connections and never answers.
+	ln := listenLoopback(t, "tcp4")
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := (&SOCKS5Dialer{Addr: ln.Addr().String()}).DialContext(ctx, "tcp", "example.com:80")
+	if !isTimeout(err) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		url  string
+		want Dialer
+	}{
+		{"socks5://h:1080", &SOCKS5Dialer{Addr: "h:1080"}},
+		{"socks5://alice:secret@h:1080", &SOCKS5Dialer{Addr: "h:1080", Username: "alice", Password: "secret"}},
+		{"socks4://bob@h:1080", &SOCKS4Dialer{Addr: "h:1080", UserID: "bob", Resolve: true}},
+		{"socks4a://h:1080", &SOCKS4Dialer{Addr: "h:1080"}},
+		{"http://alice:secret@[2001:db8::1]:3128", &HTTPDialer{Addr: "[2001:db8::1]:3128", Username: "alice", Password: "secret"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseUpstream(tt.url)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseUpstream(%q) = %+v, %v, want %+v", tt.url, got, err, tt.want)
+		}
+	}
+
+	for _, url := range []string{"ftp://h:21", "socks5://h", "socks5://h:1080/path", "h:1080"} {
+		if _, err := ParseUpstream(url); err == nil {
+			t.Errorf("ParseUpstream(%q) succeeded", url)
+		}
+	}
+}